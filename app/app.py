@@ -1,15 +1,51 @@
 import altair as alt
+import hashlib
+import heapq
+import io
+import itertools
+import json
+import os
+import re
+import time
+import numpy as np
 import pandas as pd
 import streamlit as st
-from datetime import datetime
+from datetime import datetime, timezone
+from decimal import Decimal, ROUND_HALF_UP
+from typing import Iterator
 from dateutil.relativedelta import relativedelta
+from eventparse import parse_event
+from metrics import (billing_cycles, discounted_metrics, earliest_affordable_date, health_score, key_metrics,
+                     networth_statement, period_summary, runway, threshold_alerts)
+from montecarlo import (DISTRIBUTIONS, PERCENTILES, distribution_assumptions, path_statistics, probability_negative,
+                        safe_withdrawal, simulate_balances)
+from scenario import dump_scenario, load_scenario
+from statement import PARSERS, detect_recurring, parse_statement
 
 TODAY = datetime.now()
 TOMORROW = TODAY + relativedelta(days=+1)
 END_OF_YEAR = TODAY.date().replace(month=12, day=31)
 DATE_MAX = TODAY + relativedelta(years=+1)
+SCENARIOS_DIR = os.environ.get('CASHFLOWSIM_SCENARIOS_DIR')
+SCENARIO_EXTENSIONS = ('.csv', '.xlsx', '.json')
+MAX_UPLOAD_BYTES = int(os.environ.get('CASHFLOWSIM_MAX_UPLOAD_MB', 5)) * 1024 * 1024
+MAX_EVENTS = int(os.environ.get('CASHFLOWSIM_MAX_EVENTS', 50000))
+MAX_ITEMS = int(os.environ.get('CASHFLOWSIM_MAX_ITEMS', 1000000))  # generated cashflow items
+AUDIT_LOG = os.environ.get('CASHFLOWSIM_AUDIT_LOG')
+CACHE_TTL = int(os.environ.get('CASHFLOWSIM_CACHE_TTL', 600))  # seconds
+CACHE_MAX_ENTRIES = 2 * MAX_EVENTS  # cached event expansions, enough for the events of a run and its last edit
+RUN_CACHE_MAX_ENTRIES = 20  # cached simulation results
+EXPORT_CACHE_MAX_ENTRIES = 20  # cached download files
+MAX_DETAIL_SHEETS = 100  # xlsx sheets of single events, the others share one sheet
 
-INPUT_HEADER = ['name', 'start_date', 'end_date', 'frequency', 'value', 'obs']
+INPUT_HEADER = ['name', 'start_date', 'end_date', 'frequency', 'value', 'delay', 'delay_max', 'confidence', 'vat_rate', 'currency', 'account', 'to_account', 'distribution', 'spread', 'probability', 'branch', 'exclusive', 'state', 'obs']
+FX_HEADER = ['currency', 'start_date', 'rate']
+ACCOUNT_HEADER = ['account', 'balance', 'limit', 'notice_days', 'penalty']
+CORRELATION_HEADER = ['event_a', 'event_b', 'correlation']
+DEFAULT_ACCOUNT = 'main'
+CREDIT_LINE_ACCOUNT = 'credit line'
+FX_SHOCK_HEADER = ['currency', 'start_date', 'end_date', 'change']
+HISTORY_HEADER = ['year', 'return', 'inflation']
 FREQUENCIES = {
     'daily': relativedelta(days=+1),
     'weekly':  relativedelta(weeks=+1),
@@ -18,6 +54,26 @@ FREQUENCIES = {
     'semi-annual': relativedelta(months=+6),
     'annual': relativedelta(years=+1),
 }
+CONFIDENCE_LEVELS = ['committed', 'likely', 'speculative']
+EVENT_STATES = ['active', 'draft', 'archived']
+VAT_FILING_FREQUENCIES = ['', 'monthly', 'quarterly', 'semi-annual', 'annual']
+VAT_PERIOD_MONTHS = {'monthly': 1, 'quarterly': 3, 'semi-annual': 6, 'annual': 12}
+DELAY_STEP_DAYS = 7  # collection interval of payments with a delay range
+
+
+def to_cents(value) -> int:
+    return int((Decimal(str(value)) * 100).quantize(Decimal(1), rounding=ROUND_HALF_UP))
+
+
+def from_cents(cents: int) -> float:
+    return cents / 100
+
+
+def format_items(items: list[dict]) -> str:
+    if not items:
+        return ''
+    return str([{k: from_cents(v) if k in ('value', 'vat', 'original_value') else v for k, v in item.items()}
+                for item in items])
 
 
 def is_date_valid(date) -> bool:
@@ -30,6 +86,32 @@ def get_next_date(current_date: datetime, frequency: str) -> datetime:
     return current_date + FREQUENCIES[frequency]
 
 
+def get_prev_date(current_date: datetime, frequency: str, periods: int = 1) -> datetime:
+    if not frequency or frequency not in FREQUENCIES or FREQUENCIES[frequency] is None:
+        return None
+    return current_date - FREQUENCIES[frequency] * periods
+
+
+def get_dates_backward(anchor: datetime, frequency: str, earliest: datetime) -> list[datetime]:
+    # counted from the anchor each time, as month ends drift when stepping back (03-31, 02-28, 01-28)
+    dates = []
+    current_date = anchor
+    while current_date and earliest <= current_date:
+        dates.append(current_date)
+        current_date = get_prev_date(anchor, frequency, len(dates))
+    return dates
+
+
+def savings_start_date(goal: float,
+                       contribution: float,
+                       deadline: datetime,
+                       frequency: str,
+                       earliest: datetime) -> datetime:
+    dates = get_dates_backward(deadline, frequency, earliest)
+    needed = -(-to_cents(goal) // to_cents(contribution))
+    return dates[needed - 1] if len(dates) >= needed else None
+
+
 def get_first_date(event: dict, cf_begin: datetime, cf_end: datetime) -> datetime:
     start_date = event['start_date']
     if cf_end < start_date:
@@ -51,49 +133,594 @@ def get_first_date(event: dict, cf_begin: datetime, cf_end: datetime) -> datetim
     return current_date
 
 
+def get_delay(event: dict) -> relativedelta:
+    delay = event.get('delay')
+    if delay is None or pd.isnull(delay):
+        return relativedelta()
+    return relativedelta(days=+int(delay))
+
+
+def split_delay(event: dict) -> list[dict]:
+    delay, delay_max = event.get('delay'), event.get('delay_max')
+    delay = 0 if delay is None or pd.isnull(delay) else int(delay)
+    if delay_max is None or pd.isnull(delay_max) or delay_max <= delay or pd.isnull(event['value']):
+        return [event]
+    delays = list(range(delay, int(delay_max), DELAY_STEP_DAYS)) + [int(delay_max)]
+    cents = to_cents(event['value'])
+    part, remainder = divmod(abs(cents), len(delays))
+    sign = -1 if cents < 0 else 1
+    return [dict(event, delay=d, delay_max=None, value=from_cents(sign * (part + (i < remainder))))
+            for i, d in enumerate(delays)]
+
+
+def get_vat(event: dict) -> int:
+    rate = event.get('vat_rate')
+    if rate is None or pd.isnull(rate) or rate == 0:
+        return 0
+    # event values are gross amounts, so extract the VAT portion
+    rate = Decimal(str(rate))
+    vat = Decimal(to_cents(event['value'])) * rate / (100 + rate)
+    return int(vat.quantize(Decimal(1), rounding=ROUND_HALF_UP))
+
+
+def get_vat_period_end(date: datetime, frequency: str) -> datetime:
+    # filing periods follow the calendar (months, quarters, halves and years), not the simulation start
+    months = VAT_PERIOD_MONTHS[frequency]
+    last_month = ((date.month - 1) // months + 1) * months
+    return date.replace(month=last_month, day=1) + relativedelta(months=+1, days=-1)
+
+
+def vat_settlement(vat: int) -> dict:
+    return {'name': 'VAT settlement', 'value': -vat, 'account': DEFAULT_ACCOUNT}
+
+
+def get_fx_rate(fx_rates: list[dict], currency: str, date: datetime) -> float:
+    rates = [fx for fx in fx_rates or []
+             if fx['currency'] == currency and not pd.isnull(fx['rate'])
+             and (not is_date_valid(fx['start_date']) or fx['start_date'] <= date)]
+    if not rates:
+        raise ValueError(f'Missing FX rate for currency {currency} at {date:%Y.%m.%d}')
+    return max(rates, key=lambda fx: fx['start_date'] if is_date_valid(fx['start_date']) else pd.Timestamp.min)['rate']
+
+
+def apply_fx_shocks(rate: float, fx_shocks: list[dict], currency: str, date: datetime) -> float:
+    for shock in fx_shocks or []:
+        if shock['currency'] != currency or pd.isnull(shock['change']) or not is_date_valid(shock['start_date']):
+            continue
+        if shock['start_date'] <= date and (not is_date_valid(shock['end_date']) or date <= shock['end_date']):
+            rate *= 1 + shock['change'] / 100  # e.g. -10 for a 10% drop
+    return rate
+
+
+def convert_cents(cents: int, rate: float) -> int:
+    return int((Decimal(cents) * Decimal(str(rate))).quantize(Decimal(1), rounding=ROUND_HALF_UP))
+
+
+def get_probability(event: dict) -> float:
+    probability = event.get('probability')
+    if probability is None or pd.isnull(probability):
+        return 1.0
+    return probability / 100
+
+
+def get_confidence(event: dict) -> str:
+    confidence = event.get('confidence')
+    if pd.isnull(confidence) or not confidence:
+        return CONFIDENCE_LEVELS[0]  # events without confidence are committed
+    return confidence
+
+
+def get_account(event: dict, column: str = 'account') -> str:
+    account = event.get(column)
+    if pd.isnull(account) or not account:
+        return DEFAULT_ACCOUNT if column == 'account' else None
+    return account
+
+
+def income_expenses(items: list[dict]) -> tuple[int, int]:
+    values = [item['value'] for item in items if not item.get('transfer')]
+    return sum(value for value in values if value > 0), sum(value for value in values if value < 0)
+
+
+def sum_by_account(items: list[dict]) -> dict:
+    accounts = {}
+    for item in items:
+        accounts[item['account']] = accounts.get(item['account'], 0) + item['value']
+    return accounts
+
+
+def overlay_shocks(events: list[dict], shocks: list[dict]) -> list[dict]:
+    return events + [dict(shock, shock=True) for shock in shocks]
+
+
+def split_branches(events: list[dict]) -> tuple[list[dict], dict]:
+    shared, branches = [], {}
+    for event in events:
+        branch = event.get('branch')
+        if pd.isnull(branch) or not branch:
+            shared.append(event)
+        else:
+            branches.setdefault(branch, []).append(event)
+    return shared, {branch: shared + branch_events for branch, branch_events in sorted(branches.items())}
+
+
+def get_state(event: dict) -> str:
+    state = event.get('state')
+    if pd.isnull(state) or not state:
+        return EVENT_STATES[0]  # events without state are active
+    return state
+
+
+def filter_events_by_state(events: list[dict], include_drafts: bool = False) -> list[dict]:
+    states = ['active', 'draft'] if include_drafts else ['active']
+    return [event for event in events if get_state(event) in states]
+
+
+def filter_events_by_confidence(events: list[dict], levels: list[str]) -> list[dict]:
+    return [event for event in events if get_confidence(event) in levels]
+
+
+def get_period(event: dict) -> tuple:
+    if is_date_valid(event.get('end_date')):
+        return event['start_date'], event['end_date']
+    frequency = event.get('frequency')
+    return event['start_date'], pd.Timestamp.max if not pd.isnull(frequency) and frequency else event['start_date']
+
+
+def is_exclusive(event: dict) -> bool:
+    exclusive = event.get('exclusive')
+    return not pd.isnull(exclusive) and bool(exclusive)
+
+
+def validate_events(events: list[dict]) -> list[dict]:
+    problems = []
+    periods = {}
+    for row, event in enumerate(events, 1):  # as numbered in the editor, which shows no index
+        errors, warnings = [], []
+        if not is_date_valid(event.get('start_date')):
+            errors.append(('start_date', 'missing start date'))
+        elif is_date_valid(event.get('end_date')) and event['end_date'] < event['start_date']:
+            errors.append(('end_date', 'end date before start date'))
+        elif is_exclusive(event) and get_state(event) == 'active':
+            branch = event.get('branch')
+            key = (event.get('name'), None if pd.isnull(branch) or not branch else branch)
+            start, end = get_period(event)
+            for other_row, (other_start, other_end) in periods.get(key, []):
+                if start <= other_end and other_start <= end:
+                    warnings.append(('start_date', f'overlaps exclusive row {other_row} of the same name and branch'))
+                    break
+            periods.setdefault(key, []).append((row, (start, end)))
+        frequency = event.get('frequency')
+        if not pd.isnull(frequency) and frequency and frequency not in FREQUENCIES:
+            errors.append(('frequency', f'invalid frequency: {frequency}'))
+        if pd.isnull(event.get('value')):
+            errors.append(('value', 'missing value'))
+        probability = event.get('probability')
+        if not pd.isnull(probability) and not 0 <= probability <= 100:
+            errors.append(('probability', 'probability must be between 0 and 100'))
+        delay, delay_max = event.get('delay'), event.get('delay_max')
+        if not pd.isnull(delay_max) and not pd.isnull(delay) and delay_max < delay:
+            errors.append(('delay_max', 'maximum delay below the payment delay'))
+        spread = event.get('spread')
+        if not pd.isnull(spread) and spread < 0:
+            errors.append(('spread', 'spread must not be negative'))
+        to_account = get_account(event, 'to_account')
+        if to_account and to_account == get_account(event):
+            errors.append(('to_account', 'transfer to the same account'))
+        problems += [{'row': row, 'name': event.get('name'), 'column': column, 'severity': severity, 'error': error}
+                     for severity, found in (('error', errors), ('warning', warnings)) for column, error in found]
+    return problems
+
+
+def expand_event(event: dict,
+                 cf_begin: pd.Timestamp,
+                 cf_end: pd.Timestamp,
+                 base_currency: str = None,
+                 fx_rates: list[dict] = None,
+                 fx_shocks: list[dict] = None) -> Iterator[tuple]:
+    if pd.isnull(event['value']) or event['value'] == 0:
+        return
+    frequency = event.get('frequency')
+    if not pd.isnull(frequency) and frequency and frequency not in FREQUENCIES:
+        raise ValueError(f'Invalid frequency: {frequency}')
+    parts = split_delay(event)
+    if len(parts) > 1:
+        yield from heapq.merge(*[expand_event(part, cf_begin, cf_end, base_currency, fx_rates, fx_shocks)
+                                 for part in parts], key=lambda occurrence: occurrence[0])
+        return
+    currency = event.get('currency')
+    if pd.isnull(currency) or not currency or currency == base_currency:
+        currency = None  # event already in base currency
+    account, to_account = get_account(event), get_account(event, 'to_account')
+    # events are generated on the issue date and paid after the delay
+    delay = get_delay(event)
+    issue_begin, issue_end = cf_begin - delay, cf_end - delay
+    current_date = get_first_date(event, issue_begin, issue_end)
+    while current_date and issue_begin <= current_date <= issue_end:
+        if is_date_valid(event['end_date']) and event['end_date'] < current_date:
+            break
+        payment_date = current_date + delay
+        cf = {'name': event['name'], 'value': to_cents(event['value']), 'account': account}
+        if event.get('shock'):
+            cf['shock'] = True
+        vat = get_vat(event)
+        if currency:
+            rate = get_fx_rate(fx_rates, currency, payment_date)
+            rate = apply_fx_shocks(rate, fx_shocks, currency, payment_date)
+            cf['currency'] = currency
+            cf['original_value'] = cf['value']
+            cf['value'] = convert_cents(cf['value'], rate)
+            vat = convert_cents(vat, rate)
+        if to_account:
+            # transfers move the value between accounts without changing the net worth
+            yield payment_date, dict(cf, value=-cf['value'], transfer=True)
+            yield payment_date, dict(cf, account=to_account, transfer=True)
+        else:
+            distribution = event.get('distribution')
+            if not pd.isnull(distribution) and distribution and not pd.isnull(event.get('spread')):
+                cf['distribution'] = distribution
+                cf['spread'] = event['spread']
+            probability = get_probability(event)
+            if probability < 1:
+                # uncertain events count for their expected value, Monte Carlo samples if they happen; their VAT
+                # settlement keeps the expected value on every path
+                cf['probability'] = probability
+                cf['value'] = convert_cents(cf['value'], probability)
+                vat = convert_cents(vat, probability)
+            if vat:
+                cf['vat'] = vat
+            yield payment_date, cf
+        current_date = get_next_date(current_date, event['frequency'])
+
+
+def guard_occurrences(event: dict, occurrences: Iterator[tuple], errors: list = None) -> Iterator[tuple]:
+    # events fail on their first occurrence, as FX rates only get added over time
+    try:
+        first = next(occurrences, None)
+    except Exception as e:
+        if errors is None:
+            raise
+        errors.append({'name': event.get('name'), 'error': str(e) or type(e).__name__})
+        return
+    if first is not None:
+        yield first
+        yield from occurrences
+
+
+def iter_cashflows(events: list[dict],
+                   cf_begin: pd.Timestamp,
+                   cf_end: pd.Timestamp,
+                   vat_frequency: str = None,
+                   base_currency: str = None,
+                   fx_rates: list[dict] = None,
+                   fx_shocks: list[dict] = None,
+                   errors: list = None,
+                   credit_line: dict = None,
+                   ladder: dict = None) -> Iterator[dict]:
+    streams = [guard_occurrences(event, expand_event(event, cf_begin, cf_end, base_currency, fx_rates, fx_shocks),
+                                 errors)
+               for event in events]
+    return apply_accounts(merge_cashflows(streams, cf_begin, cf_end, vat_frequency), cf_begin, cf_end, credit_line,
+                          ladder)
+
+
+def merge_cashflows(streams: list[Iterator[tuple]],
+                    cf_begin: pd.Timestamp,
+                    cf_end: pd.Timestamp,
+                    vat_frequency: str = None) -> Iterator[dict]:
+    assert (cf_begin <= cf_end)
+    merged = heapq.merge(*streams, key=lambda occurrence: occurrence[0])
+    # VAT collected on income is paid and VAT paid on expenses is deducted at the end of each filing period
+    period_end = get_vat_period_end(cf_begin, vat_frequency) if vat_frequency else None
+    vat = 0
+    for date, occurrences in itertools.groupby(merged, key=lambda occurrence: occurrence[0]):
+        items = [item for _, item in occurrences]
+        while period_end and period_end < date:
+            if vat:
+                yield {'date': period_end, 'cashflow': -vat, 'balance': 0, 'items': [vat_settlement(vat)]}
+            period_end, vat = get_vat_period_end(period_end + relativedelta(days=+1), vat_frequency), 0
+        vat += sum(item.get('vat', 0) for item in items)
+        if period_end == date:
+            if vat:
+                items.append(vat_settlement(vat))
+            period_end, vat = get_vat_period_end(period_end + relativedelta(days=+1), vat_frequency), 0
+        yield {'date': date, 'cashflow': sum(item['value'] for item in items), 'balance': 0, 'items': items}
+    while period_end and period_end <= cf_end:
+        if vat:
+            yield {'date': period_end, 'cashflow': -vat, 'balance': 0, 'items': [vat_settlement(vat)]}
+        period_end, vat = get_vat_period_end(period_end + relativedelta(days=+1), vat_frequency), 0
+
+
 def generate_cashflows(events: list[dict],
                        cf_begin: pd.Timestamp,
-                       cf_end: pd.Timestamp) -> pd.DataFrame:
-    assert (cf_begin <= cf_end)
-    cf_list = {}
+                       cf_end: pd.Timestamp,
+                       vat_frequency: str = None,
+                       base_currency: str = None,
+                       fx_rates: list[dict] = None,
+                       fx_shocks: list[dict] = None,
+                       errors: list = None,
+                       credit_line: dict = None,
+                       ladder: dict = None,
+                       max_items: int = MAX_ITEMS) -> list[dict]:
+    cashflows, truncated = take_cashflows(iter_cashflows(events, cf_begin, cf_end, vat_frequency, base_currency,
+                                                         fx_rates, fx_shocks, errors, credit_line, ladder),
+                                             max_items)
+    if truncated:
+        raise ValueError(f'More than {max_items} cashflow items. Shorten the period or use less frequent events')
+    return cashflows
+
+
+@st.cache_data(ttl=CACHE_TTL, max_entries=CACHE_MAX_ENTRIES, show_spinner=False)
+def expand_event_cached(event: dict,
+                        cf_begin: pd.Timestamp,
+                        cf_end: pd.Timestamp,
+                        base_currency: str = None,
+                        fx_rates: list[dict] = None,
+                        fx_shocks: list[dict] = None,
+                        max_items: int = MAX_ITEMS) -> tuple[list, list]:
+    try:
+        occurrences = expand_event(event, cf_begin, cf_end, base_currency, fx_rates, fx_shocks)
+        return list(itertools.islice(occurrences, max_items + 1)), []
+    except Exception as e:
+        return [], [{'name': event.get('name'), 'error': str(e) or type(e).__name__}]
+
+
+def iter_cashflows_cached(events: list[dict],
+                          cf_begin: pd.Timestamp,
+                          cf_end: pd.Timestamp,
+                          vat_frequency: str = None,
+                          base_currency: str = None,
+                          fx_rates: list[dict] = None,
+                          fx_shocks: list[dict] = None,
+                          credit_line: dict = None,
+                          ladder: dict = None,
+                          max_items: int = MAX_ITEMS) -> tuple[Iterator[dict], list]:
+    expansions, items = [], 0
     for event in events:
-        if event['value'] == 0:
-            continue
-        current_date = get_first_date(event, cf_begin, cf_end)
-        while current_date and cf_begin <= current_date <= cf_end:
-            if is_date_valid(event['end_date']) and event['end_date'] < current_date:
+        expansions.append(expand_event_cached(event, cf_begin, cf_end, base_currency, fx_rates, fx_shocks, max_items))
+        items += len(expansions[-1][0])
+        if items > max_items:
+            break
+    errors = [error for _, event_errors in expansions for error in event_errors]
+    # results over the limit are cut anyway, so the remaining events are streamed instead of held in the cache; the
+    # cut lists are complete up to a date the results never reach
+    streams = [occurrences for occurrences, _ in expansions]
+    streams += [guard_occurrences(event, expand_event(event, cf_begin, cf_end, base_currency, fx_rates, fx_shocks),
+                                  errors)
+                for event in events[len(expansions):]]
+    cashflows = merge_cashflows(streams, cf_begin, cf_end, vat_frequency)
+    return apply_accounts(cashflows, cf_begin, cf_end, credit_line, ladder), errors
+
+
+def run_simulation(events: list[dict],
+                   cf_begin: pd.Timestamp,
+                   cf_end: pd.Timestamp,
+                   vat_frequency: str = None,
+                   base_currency: str = None,
+                   fx_rates: list[dict] = None,
+                   fx_shocks: list[dict] = None,
+                   credit_line: dict = None,
+                   ladder: dict = None,
+                   cache_events: bool = False) -> tuple[list, bool, list]:
+    if cache_events and len(events) <= CACHE_MAX_ENTRIES:
+        stream, errors = iter_cashflows_cached(events, cf_begin, cf_end, vat_frequency, base_currency, fx_rates,
+                                               fx_shocks, credit_line, ladder)
+    else:
+        errors = []
+        stream = iter_cashflows(events, cf_begin, cf_end, vat_frequency, base_currency, fx_rates, fx_shocks, errors,
+                                credit_line, ladder)
+    cashflows, truncated = take_cashflows(stream, MAX_ITEMS)
+    return cashflows, truncated, errors
+
+
+@st.cache_data(ttl=CACHE_TTL, max_entries=RUN_CACHE_MAX_ENTRIES, show_spinner=False)
+def cached_simulation(inputs_hash: str, _run) -> tuple[list, bool, list]:
+    return _run()
+
+
+def take_cashflows(cashflows: Iterator[dict], max_items: int) -> tuple[list, bool]:
+    taken, items = [], 0
+    for cf in cashflows:
+        items += len(cf['items'])
+        if items > max_items:
+            return taken, True
+        taken.append(cf)
+    return taken, False
+
+
+def sort_items(cashflows: list) -> list:
+    for cf in cashflows:
+        cf['items'].sort(key=lambda item: str(item['name']))  # stable, so transfer legs keep their order
+    return cashflows
+
+
+def balance_range(initial_balance: int, cashflows: list) -> tuple[int, int]:
+    balances = initial_balance + np.cumsum([0] + [cf['cashflow'] for cf in cashflows], dtype=np.int64)
+    return int(balances[-1]), int(balances.min())
+
+
+def scale_events(events: list[dict], name: str, change: float) -> list[dict]:
+    return [dict(event, value=event['value'] * (1 + change / 100)) if event['name'] == name else event
+            for event in events]
+
+
+def sensitivity_analysis(events: list[dict],
+                         cf_begin: pd.Timestamp,
+                         cf_end: pd.Timestamp,
+                         initial_balance: int,
+                         parameters: dict,
+                         **options) -> list[dict]:
+    results = []
+    for changes in itertools.product(*parameters.values()):
+        scaled_events = events
+        for name, change in zip(parameters, changes):
+            scaled_events = scale_events(scaled_events, name, change)
+        cashflows = generate_cashflows(scaled_events, cf_begin, cf_end, errors=[], **options)
+        final_balance, min_balance = balance_range(initial_balance, cashflows)
+        results.append({**dict(zip(parameters, changes)),
+                        'final_balance': from_cents(final_balance),
+                        'min_balance': from_cents(min_balance)})
+    return results
+
+
+def account_transfer(name: str, value: int, account: str) -> list[dict]:
+    return [{'name': name, 'value': value, 'account': DEFAULT_ACCOUNT, 'transfer': True},
+            {'name': name, 'value': -value, 'account': account, 'transfer': True}]
+
+
+def cover_shortfalls(cashflows: Iterator[dict],
+                     cf_begin: pd.Timestamp,
+                     balances: dict,
+                     sources: list[dict]) -> Iterator[dict]:
+    # notice is given at the start, a source costs its early withdrawal penalty until its notice period is over
+    balances = dict(balances)
+    for cf in cashflows:
+        for account, value in sum_by_account(cf['items']).items():
+            balances[account] = balances.get(account, 0) + value
+        days = (cf['date'] - cf_begin).days
+        rates = {source['account']: 0 if days >= source['notice_days'] else source['penalty'] / 100
+                 for source in sources}
+        for account in sorted(rates, key=rates.get):
+            shortfall, available = -balances.get(DEFAULT_ACCOUNT, 0), balances.get(account, 0)
+            if shortfall <= 0:
                 break
-            if not current_date in cf_list:
-                cf_list[current_date] = []
-            cf = {'name': event['name'], 'value': event['value']}
-            cf_list[current_date].append(cf)
-            current_date = get_next_date(current_date, event['frequency'])
-    cashflows = []
-    for k, v in sorted(cf_list.items()):
-        cashflows.append({
-            'date': k,
-            'cashflow': sum([item['value'] for item in v]),
-            'balance': 0,
-            'items': str(v)
-        })
+            withdrawal = min(shortfall, int(Decimal(available) / (1 + Decimal(str(rates[account])))))
+            if withdrawal <= 0:
+                continue
+            penalty = min(convert_cents(withdrawal, rates[account]), available - withdrawal)
+            cf['items'] += account_transfer(f'Withdrawal from {account}', withdrawal, account)
+            if penalty:
+                cf['items'].append({'name': f'Early withdrawal penalty ({account})', 'value': -penalty,
+                                    'account': account, 'penalty': True})
+                cf['cashflow'] -= penalty
+            balances[DEFAULT_ACCOUNT] += withdrawal
+            balances[account] -= withdrawal + penalty
+        yield cf
+
+
+def apply_accounts(cashflows: Iterator[dict],
+                   cf_begin: pd.Timestamp,
+                   cf_end: pd.Timestamp,
+                   credit_line: dict = None,
+                   ladder: dict = None) -> Iterator[dict]:
+    if ladder:
+        cashflows = cover_shortfalls(cashflows, cf_begin, **ladder)
+    if credit_line:
+        cashflows = apply_credit_line(cashflows, cf_begin, cf_end, **credit_line)
     return cashflows
 
 
-def balance_from_cashflows(initial_balance_value: int,
+def apply_credit_line(cashflows: Iterator[dict],
+                      cf_begin: pd.Timestamp,
+                      cf_end: pd.Timestamp,
+                      balance: int,
+                      limit: int,
+                      apr: float = 0) -> Iterator[dict]:
+    # interest accrues daily on the drawn amount and is charged monthly
+    daily_rate = Decimal(str(apr or 0)) / 100 / 365
+    charge_dates = []
+    charge_date = get_next_date(cf_begin, 'monthly')
+    while charge_date <= cf_end:
+        charge_dates.append(charge_date)
+        charge_date = get_next_date(charge_date, 'monthly')
+    charges = [{'date': date, 'cashflow': 0, 'balance': 0, 'items': []} for date in charge_dates]
+    drawn, accrued, last_date = 0, Decimal(0), cf_begin
+    # on a charge date the event cashflow comes first, the empty charge cashflow is only used when there is none
+    merged = heapq.merge(cashflows, charges, key=lambda cf: cf['date'])
+    for date, same_date in itertools.groupby(merged, key=lambda cf: cf['date']):
+        cf = next(same_date)
+        accrued += drawn * daily_rate * (date - last_date).days
+        last_date = date
+        if date in charge_dates:
+            interest = int(accrued.quantize(Decimal(1), rounding=ROUND_HALF_UP))
+            if interest:
+                cf['items'].append({'name': 'Credit line interest', 'value': -interest, 'account': DEFAULT_ACCOUNT})
+                cf['cashflow'] -= interest
+            accrued = Decimal(0)
+        balance += sum_by_account(cf['items']).get(DEFAULT_ACCOUNT, 0)
+        if balance < 0 and drawn < limit:
+            draw = min(-balance, limit - drawn)
+            cf['items'] += account_transfer('Credit line draw', draw, CREDIT_LINE_ACCOUNT)
+            balance, drawn = balance + draw, drawn + draw
+        elif balance > 0 and drawn > 0:
+            repayment = min(balance, drawn)
+            cf['items'] += account_transfer('Credit line repayment', -repayment, CREDIT_LINE_ACCOUNT)
+            balance, drawn = balance - repayment, drawn - repayment
+        if cf['items']:
+            yield cf
+
+
+def balance_from_cashflows(initial_balance_value: float,
                            sim_start: pd.Timestamp,
-                           cashflows: list) -> pd.DataFrame:
-    initial_cf = [{
-        'date': sim_start,
-        'cashflow': 0,
-        'balance': initial_balance_value,
-        'items': ''
-    }]
-    running_balance = initial_balance_value
-    for cf in cashflows:
-        running_balance += cf['cashflow']
-        cf['balance'] = running_balance
-    cf_list = initial_cf + cashflows
-    return pd.DataFrame.from_records(cf_list)
+                           cashflows: list,
+                           account_balances: dict = None) -> pd.DataFrame:
+    balances = {DEFAULT_ACCOUNT: to_cents(initial_balance_value)}
+    for account, value in (account_balances or {}).items():
+        balances[account] = balances.get(account, 0) + to_cents(value)
+    accounts = sorted(set(balances) | {item['account'] for cf in cashflows for item in cf['items']})
+    totals = [income_expenses(cf['items']) for cf in cashflows]
+    df = pd.DataFrame.from_records([{'date': sim_start, 'cashflow': 0, 'income': 0, 'expenses': 0, 'balance': 0,
+                                     'items': []}] +
+                                   [{'date': cf['date'], 'cashflow': cf['cashflow'], 'income': income,
+                                     'expenses': expenses, 'balance': 0, 'items': cf['items']}
+                                    for cf, (income, expenses) in zip(cashflows, totals)])
+    # running balances are cumulative sums over int64 cents, converted to units only at the end
+    df['balance'] = sum(balances.values()) + df['cashflow'].astype('int64').cumsum()
+    if len(accounts) > 1:  # single account balance is the consolidated balance
+        by_account = pd.DataFrame([{}] + [sum_by_account(cf['items']) for cf in cashflows], columns=accounts)
+        by_account = by_account.fillna(0).astype('int64').cumsum() + pd.Series(balances).reindex(accounts, fill_value=0)
+        for account in accounts:
+            df[f'balance_{account}'] = by_account[account]
+    df['items'] = df['items'].map(format_items)
+    for col in df.columns:
+        if col in ('cashflow', 'income', 'expenses') or col.startswith('balance'):
+            df[col] = df[col] / 100
+    return df
+
+
+def find_infeasible(balances: list[dict], limits: dict) -> list[dict]:
+    infeasible = []
+    for account, limit in sorted(limits.items()):
+        column = f'balance_{account}'
+        if column not in balances[0]:
+            if account != DEFAULT_ACCOUNT:
+                continue
+            column = 'balance'
+        breach = next((cf for cf in balances if cf[column] < -limit), None)
+        if breach:
+            infeasible.append({
+                'date': breach['date'],
+                'account': account,
+                'balance': breach[column],
+                'limit': limit,
+                'shortfall': round(-limit - breach[column], 2),
+            })
+    return sorted(infeasible, key=lambda i: i['date'])
+
+
+def expand_salary(name: str,
+                  start_date: pd.Timestamp,
+                  end_date: pd.Timestamp,
+                  base_value: float,
+                  raise_rate: float,
+                  deduction_rate: float,
+                  bonus_value: float,
+                  bonus_frequency: str) -> list[dict]:
+    events = []
+    period_start = start_date
+    while period_start <= end_date:
+        period_end = min(period_start + relativedelta(years=+1, days=-1), end_date)
+        events.append({'name': f'{name} (base)', 'start_date': period_start, 'end_date': period_end,
+                       'frequency': 'monthly', 'value': round(base_value, 2)})
+        if deduction_rate:
+            events.append({'name': f'{name} (deductions)', 'start_date': period_start, 'end_date': period_end,
+                           'frequency': 'monthly', 'value': -round(base_value * deduction_rate / 100, 2)})
+        period_start += relativedelta(years=+1)
+        base_value *= 1 + raise_rate / 100
+    if bonus_value:
+        events.append({'name': f'{name} (bonus)', 'start_date': get_next_date(start_date, bonus_frequency),
+                       'end_date': end_date, 'frequency': bonus_frequency, 'value': bonus_value})
+    return events
 
 
 def create_input_dataframe() -> pd.DataFrame:
@@ -104,15 +731,79 @@ def setup_input_dataframe(df: pd.DataFrame) -> pd.DataFrame:
     df['name'] = df['name'].astype("string")
     df['start_date'] = pd.to_datetime(df['start_date'], format='%Y-%m-%d')
     df['end_date'] = pd.to_datetime(df['end_date'], format='%Y-%m-%d')
-    df['value'] = df['value'].astype("int64")
+    df['value'] = df['value'].astype("float64")
     df['frequency'] = df['frequency'].astype("string")
+    df['delay'] = df['delay'].astype("Int64")
+    df['delay_max'] = df['delay_max'].astype("Int64")
+    df['confidence'] = df['confidence'].astype("string")
+    df['vat_rate'] = df['vat_rate'].astype("float64")
+    df['currency'] = df['currency'].astype("string")
+    df['account'] = df['account'].astype("string")
+    df['to_account'] = df['to_account'].astype("string")
+    df['distribution'] = df['distribution'].astype("string")
+    df['spread'] = df['spread'].astype("float64")
+    df['probability'] = df['probability'].astype("float64")
+    df['branch'] = df['branch'].astype("string")
+    df['exclusive'] = df['exclusive'].astype("boolean")
+    df['state'] = df['state'].astype("string")
     df['obs'] = df['obs'].astype("string")
     return df
 
 
+def create_fx_dataframe() -> pd.DataFrame:
+    df = pd.DataFrame(columns=FX_HEADER)
+    df['currency'] = df['currency'].astype("string")
+    df['start_date'] = pd.to_datetime(df['start_date'])
+    df['rate'] = df['rate'].astype("float64")
+    return df
+
+
+def create_account_dataframe() -> pd.DataFrame:
+    df = pd.DataFrame(columns=ACCOUNT_HEADER)
+    df['account'] = df['account'].astype("string")
+    df['balance'] = df['balance'].astype("float64")
+    df['limit'] = df['limit'].astype("float64")
+    df['notice_days'] = df['notice_days'].astype("Int64")
+    df['penalty'] = df['penalty'].astype("float64")
+    return df
+
+
+def create_correlation_dataframe() -> pd.DataFrame:
+    df = pd.DataFrame(columns=CORRELATION_HEADER)
+    df['event_a'] = df['event_a'].astype("string")
+    df['event_b'] = df['event_b'].astype("string")
+    df['correlation'] = df['correlation'].astype("float64")
+    return df
+
+
+def create_fx_shock_dataframe() -> pd.DataFrame:
+    df = pd.DataFrame(columns=FX_SHOCK_HEADER)
+    df['currency'] = df['currency'].astype("string")
+    df['start_date'] = pd.to_datetime(df['start_date'])
+    df['end_date'] = pd.to_datetime(df['end_date'])
+    df['change'] = df['change'].astype("float64")
+    return df
+
+
+def create_history_dataframe() -> pd.DataFrame:
+    df = pd.DataFrame(columns=HISTORY_HEADER)
+    df['year'] = df['year'].astype("Int64")
+    df['return'] = df['return'].astype("float64")
+    df['inflation'] = df['inflation'].astype("float64")
+    return df
+
+
+def check_upload_size(uploadedFile):
+    # the server limit can be raised past this one, so every uploaded file is checked again
+    if getattr(uploadedFile, 'size', 0) > MAX_UPLOAD_BYTES:
+        st.error(f'File too large (max {MAX_UPLOAD_BYTES // 1024 // 1024} MB)', icon="🚨")
+        st.stop()
+
+
 def load_input_data(uploadedFile=None) -> pd.DataFrame:
     df = create_input_dataframe()
     if uploadedFile:
+        check_upload_size(uploadedFile)
         try:
             df = pd.read_excel(uploadedFile)
         except:
@@ -121,13 +812,204 @@ def load_input_data(uploadedFile=None) -> pd.DataFrame:
             except:
                 st.error('Invalid file format', icon="🚨")
                 st.stop()
+        if len(df) > MAX_EVENTS:
+            st.error(f'Too many events: {len(df)} (max {MAX_EVENTS})', icon="🚨")
+            st.stop()
         for col in df.columns.values.tolist():
             if col not in INPUT_HEADER:
                 df.drop(columns=[col], inplace=True)
                 st.warning(f'Column ignored at input file: {col}', icon="🚨")
+        for col in INPUT_HEADER:
+            if col not in df.columns:
+                df[col] = None
     return setup_input_dataframe(df)
 
 
+def parse_thresholds(text: str) -> list[float]:
+    thresholds = []
+    for value in text.split(','):
+        try:
+            thresholds.append(float(value))
+        except ValueError:
+            if value.strip():
+                st.warning(f'Invalid alert threshold ignored: {value.strip()}', icon="🚨")
+    return thresholds
+
+
+def to_parquet(df: pd.DataFrame) -> bytes:
+    buffer = io.BytesIO()
+    df.to_parquet(buffer, index=False)
+    return buffer.getvalue()
+
+
+def to_arrow(df: pd.DataFrame) -> bytes:
+    buffer = io.BytesIO()
+    df.reset_index(drop=True).to_feather(buffer)  # Feather v2 is the Arrow IPC file format
+    return buffer.getvalue()
+
+
+def to_ndjson(df: pd.DataFrame) -> bytes:
+    return df.to_json(orient='records', lines=True, date_format='iso').encode('utf-8')
+
+
+def escape_ics(text: str) -> str:
+    return str(text).replace('\\', '\\\\').replace(';', '\\;').replace(',', '\\,').replace('\n', '\\n')
+
+
+def fold_ics(line: str) -> str:
+    # content lines are folded at 75 octets, continuation lines start with a space (RFC 5545 3.1)
+    lines, line_octets = [''], 0
+    for char in line:
+        octets = len(char.encode('utf-8'))
+        if line_octets + octets > 75:
+            lines.append(' ')
+            line_octets = 1
+        lines[-1] += char
+        line_octets += octets
+    return '\r\n'.join(lines)
+
+
+def to_ics(cashflows: list) -> bytes:
+    stamp = datetime.now(timezone.utc).strftime('%Y%m%dT%H%M%SZ')
+    lines = ['BEGIN:VCALENDAR', 'VERSION:2.0', 'PRODID:-//cashflowsim//EN', 'CALSCALE:GREGORIAN']
+    for cf in cashflows:
+        events = {}
+        for item in cf['items']:
+            if not str(item['name']) in events:
+                events[str(item['name'])] = []
+            events[str(item['name'])].append(item)
+        for name, items in events.items():
+            # the UID only depends on the event and date, so re-imported calendars update the same entries
+            values = [item['value'] for item in items]
+            value = sum(values) or sum(value for value in values if value > 0)  # transfer legs cancel out
+            accounts = ', '.join(sorted({str(item['account']) for item in items}))
+            lines += [
+                'BEGIN:VEVENT',
+                f'UID:{cf["date"]:%Y%m%d}-{hashlib.sha256(name.encode()).hexdigest()[:16]}@cashflowsim',
+                f'DTSTAMP:{stamp}',
+                f'DTSTART;VALUE=DATE:{cf["date"]:%Y%m%d}',
+                f'SUMMARY:{escape_ics(name)}: {from_cents(value):.2f}',
+                f'DESCRIPTION:{escape_ics("account: " + accounts)}',
+                'END:VEVENT',
+            ]
+    lines.append('END:VCALENDAR')
+    return ('\r\n'.join(fold_ics(line) for line in lines) + '\r\n').encode('utf-8')
+
+
+@st.cache_data(ttl=CACHE_TTL, max_entries=EXPORT_CACHE_MAX_ENTRIES, show_spinner=False)
+def cached_export(key: str, _build) -> bytes:
+    return _build()
+
+
+def to_xlsx(df: pd.DataFrame, cashflows: list) -> bytes:
+    summary = pd.DataFrame([
+        ('Start date', df['date'].min()),
+        ('End date', df['date'].max()),
+        ('Initial balance', df['balance'].iloc[0]),
+        ('Final balance', df['balance'].iloc[-1]),
+        ('Minimum balance', df['balance'].min()),
+        ('Income', df['income'].sum()),
+        ('Expenses', df['expenses'].sum()),
+    ], columns=['item', 'value'])
+    monthly = df.groupby(df['date'].dt.strftime('%Y-%m')).agg(cashflow=('cashflow', 'sum'),
+                                                               balance=('balance', 'last')).reset_index()
+    details = {}
+    for cf in cashflows:
+        for item in cf['items']:
+            if not item['name'] in details:
+                details[item['name']] = []
+            details[item['name']].append({'date': cf['date'], 'value': from_cents(item['value']),
+                                          'account': item['account']})
+    buffer = io.BytesIO()
+    with pd.ExcelWriter(buffer) as writer:
+        summary.to_excel(writer, sheet_name='Summary', index=False)
+        monthly.rename(columns={'date': 'month'}).to_excel(writer, sheet_name='Monthly', index=False)
+        sheet_names = {'summary', 'monthly', 'other events'}  # Excel compares sheet names case-insensitively
+        details = sorted(details.items(), key=lambda d: str(d[0]))
+        for name, rows in details[:MAX_DETAIL_SHEETS]:
+            base_name = re.sub(r'[\[\]:*?/\\]', '', str(name))[:31] or 'Event'
+            sheet_name, counter = base_name, 1
+            while sheet_name.lower() in sheet_names:
+                counter += 1
+                sheet_name = f'{base_name[:30 - len(str(counter))]}_{counter}'
+            sheet_names.add(sheet_name.lower())
+            pd.DataFrame(rows).to_excel(writer, sheet_name=sheet_name, index=False)
+        others = [{'name': name, **row} for name, rows in details[MAX_DETAIL_SHEETS:] for row in rows]
+        if others:
+            pd.DataFrame(others).to_excel(writer, sheet_name='Other events', index=False)
+    return buffer.getvalue()
+
+
+def list_scenario_files(directory: str) -> list[str]:
+    if not directory or not os.path.isdir(directory):
+        return []
+    return sorted(f for f in os.listdir(directory) if f.lower().endswith(SCENARIO_EXTENSIONS))
+
+
+def scenario_tables() -> dict:
+    # scenario file section: (session state table, empty table with the column types)
+    return {
+        'events': ('df', load_input_data()),
+        'shocks': ('shocks', load_input_data()),
+        'accounts': ('accounts', create_account_dataframe()),
+        'fx': ('fx', create_fx_dataframe()),
+        'fx_shocks': ('fx_shocks', create_fx_shock_dataframe()),
+        'correlations': ('correlations', create_correlation_dataframe()),
+    }
+
+
+def load_scenario_file(source=None) -> dict:
+    name = source.name if hasattr(source, 'name') else str(source)
+    if not source or not name.lower().endswith('.json'):
+        return {'df': load_input_data(source)}
+    if isinstance(source, str):
+        with open(source) as f:
+            text = f.read()
+    else:
+        check_upload_size(source)
+        text = source.getvalue().decode('utf-8')
+    try:
+        sections = load_scenario(text)
+        return {key: pd.DataFrame(sections[section], columns=empty.columns).astype(empty.dtypes.to_dict())
+                for section, (key, empty) in scenario_tables().items()}
+    except (ValueError, TypeError) as e:
+        st.error(f'Invalid scenario file: {e}', icon="🚨")
+        st.stop()
+
+
+def scenario_to_json(tables: dict) -> str:
+    return dump_scenario({section: json.loads(tables[key].to_json(orient='records', date_format='iso'))
+                          for section, (key, _) in scenario_tables().items()})
+
+
+def write_audit_log(path: str, record: dict) -> bool:
+    try:
+        with open(path, 'a') as f:
+            f.write(json.dumps(record, default=str) + '\n')
+    except OSError as e:
+        st.warning(f'Audit log not written: {e}', icon="🚨")
+        return False
+    return True
+
+
+def save_scenario(tables: dict, directory: str, name: str) -> str:
+    # names are reduced to safe file names so scenarios can't be written outside the directory
+    file_name = re.sub(r'[^\w .-]', '', name).strip(' .')
+    if not file_name:
+        raise ValueError('Invalid scenario name')
+    if not file_name.lower().endswith(SCENARIO_EXTENSIONS):
+        file_name += '.csv'
+    path = os.path.join(directory, file_name)
+    if file_name.lower().endswith('.json'):
+        with open(path, 'w') as f:
+            f.write(scenario_to_json(tables))
+    elif file_name.lower().endswith('.xlsx'):
+        tables['df'].to_excel(path, index=False)
+    else:
+        tables['df'].to_csv(path, index=False)
+    return file_name
+
+
 def main():
     st.set_page_config(layout='wide', page_title="Cashflow Simulator", page_icon="🧮")
     st.title("📊 Cashflow Simulator")
@@ -135,13 +1017,47 @@ def main():
 
     "Fill in your financial events or upload a file and simulate your cash flows."
 
+    scenario_files = list_scenario_files(SCENARIOS_DIR)  # listed on every run to pick up changes
     if 'df' not in st.session_state:
-        st.session_state.df = load_input_data()
+        preloaded = os.path.join(SCENARIOS_DIR, scenario_files[0]) if scenario_files else None
+        st.session_state.update(load_scenario_file(preloaded))
+        st.session_state.scenario = scenario_files[0] if scenario_files else None
+    if 'shocks' not in st.session_state:
+        st.session_state.shocks = load_input_data()
+    if 'correlations' not in st.session_state:
+        st.session_state.correlations = create_correlation_dataframe()
+    if 'accounts' not in st.session_state:
+        st.session_state.accounts = create_account_dataframe()
+    if 'fx' not in st.session_state:
+        st.session_state.fx = create_fx_dataframe()
+    if 'fx_shocks' not in st.session_state:
+        st.session_state.fx_shocks = create_fx_shock_dataframe()
+    if 'history' not in st.session_state:
+        st.session_state.history = create_history_dataframe()
 
     with st.expander("Simulation Parameters"):
         initial_balance_value = st.number_input("Current Balance",
                                                 value=1000,
-                                                placeholder="Initial balance to consider on cashflow simulation...")
+                                                placeholder="Initial balance to consider on cashflow simulation...",
+                                                help=f"Balance of the '{DEFAULT_ACCOUNT}' account")
+        "Other accounts (events and transfers refer to them by name)"
+        accounts_edited = st.data_editor(
+            st.session_state.accounts,
+            num_rows="dynamic",
+            hide_index=True,
+            column_config={
+                "account": st.column_config.TextColumn("Account", required=True, max_chars=30),
+                "balance": st.column_config.NumberColumn("Current Balance", required=True, format="%.2f"),
+                "limit": st.column_config.NumberColumn("Overdraft Limit", min_value=0, format="%.2f",
+                                                       help="How far the account may go negative"),
+                "notice_days": st.column_config.NumberColumn("Notice Period", min_value=0, step=1,
+                                                             help="Days of notice for a withdrawal without penalty"),
+                "penalty": st.column_config.NumberColumn("Early Withdrawal Penalty", min_value=0, max_value=100,
+                                                         format="%.2f%%",
+                                                         help="Charged on withdrawals within the notice period"),
+            },
+            key="accounts_editor",
+        )
         simulation_period = st.date_input(
             "Select the simulation period",
             (TOMORROW, END_OF_YEAR),
@@ -149,6 +1065,119 @@ def main():
             DATE_MAX,
             format="YYYY.MM.DD",
         )
+        confidence_levels = st.multiselect("Confidence levels to include",
+                                           CONFIDENCE_LEVELS,
+                                           default=CONFIDENCE_LEVELS,
+                                           help="Events without a confidence level are considered committed")
+        include_drafts = st.checkbox("Include draft events",
+                                     help="Draft events are ideas left out of simulations; archived events are never simulated")
+        vat_frequency = st.selectbox("VAT filing frequency",
+                                     VAT_FILING_FREQUENCIES,
+                                     format_func=lambda f: f or 'no VAT settlement',
+                                     help="Generate VAT settlement events (collected minus deducted) for events "
+                                          "with a VAT rate, at the end of each calendar month, quarter, half or year")
+        base_currency = st.text_input("Base currency",
+                                      value="USD",
+                                      max_chars=3,
+                                      help="Currency of the balance; events in other currencies are converted")
+        "FX rates (base currency units per unit of currency, from start date onward)"
+        fx_edited = st.data_editor(
+            st.session_state.fx,
+            num_rows="dynamic",
+            hide_index=True,
+            column_config={
+                "currency": st.column_config.TextColumn("Currency", required=True, max_chars=3),
+                "start_date": st.column_config.DateColumn("Start Date", format="YYYY.MM.DD", step=1),
+                "rate": st.column_config.NumberColumn("Rate", required=True, min_value=0, format="%.4f"),
+            },
+            key="fx_editor",
+        )
+        "FX shocks (percent change of the rate between start and end dates, e.g. -10 for a 10% drop)"
+        fx_shocks_edited = st.data_editor(
+            st.session_state.fx_shocks,
+            num_rows="dynamic",
+            hide_index=True,
+            column_config={
+                "currency": st.column_config.TextColumn("Currency", required=True, max_chars=3),
+                "start_date": st.column_config.DateColumn("Start Date", required=True, format="YYYY.MM.DD", step=1),
+                "end_date": st.column_config.DateColumn("End Date", format="YYYY.MM.DD", step=1),
+                "change": st.column_config.NumberColumn("Change", required=True, format="%.2f%%"),
+            },
+            key="fx_shocks_editor",
+        )
+        col1, col2 = st.columns(2)
+        credit_limit = col1.number_input("Credit line limit",
+                                         value=0.0,
+                                         min_value=0.0,
+                                         step=100.0,
+                                         help=f"Negative '{DEFAULT_ACCOUNT}' balances are drawn from the credit line and repaid "
+                                              "as soon as the balance is positive again (0 disables it)")
+        credit_apr = col2.number_input("Credit line APR (%)",
+                                       value=0.0,
+                                       min_value=0.0,
+                                       step=0.5,
+                                       disabled=credit_limit == 0)
+        cover_from_accounts = st.checkbox("Cover shortfalls from other accounts",
+                                          help=f"Withdraw what the '{DEFAULT_ACCOUNT}' account lacks from the cheapest "
+                                               "account (past its notice period, given today, or with the lowest "
+                                               "penalty) before drawing from the credit line")
+        cache_results = st.checkbox("Cache simulation results",
+                                    value=True,
+                                    help=f"Reuse the results of identical runs and only expand the events changed "
+                                         f"since a previous run (cached for {CACHE_TTL} seconds)")
+        input_order = st.checkbox("Keep input order of same-date items",
+                                  help="By default the items of a date are sorted by event name")
+        strict_limits = st.checkbox("Strict account limits",
+                                    help="Fail the simulation when an account goes below its limit (0 when not set) "
+                                         "instead of projecting the negative balance")
+        col1, col2 = st.columns(2)
+        monte_carlo = col1.checkbox("Monte Carlo simulation",
+                                    help="Sample values of events with a distribution and show balance percentile bands")
+        monte_carlo_paths = col2.number_input("Paths",
+                                              value=1000,
+                                              min_value=100,
+                                              max_value=100000,
+                                              step=100,
+                                              disabled=not monte_carlo)
+        monte_carlo_seed = st.number_input("Random seed",
+                                           value=None,
+                                           min_value=0,
+                                           step=1,
+                                           placeholder="Random",
+                                           help="Reuse the seed of a previous run to reproduce its results "
+                                                "(Monte Carlo and retirement withdrawal simulations)")
+        monte_carlo_percentiles = st.multiselect("Percentiles",
+                                                 [1, 5, 10, 25, 50, 75, 90, 95, 99],
+                                                 default=PERCENTILES,
+                                                 disabled=not monte_carlo)
+        "Correlations between uncertain events (by event name, from -1 to 1)"
+        correlations_edited = st.data_editor(
+            st.session_state.correlations,
+            num_rows="dynamic",
+            hide_index=True,
+            column_config={
+                "event_a": st.column_config.TextColumn("Event", required=True),
+                "event_b": st.column_config.TextColumn("Correlated Event", required=True),
+                "correlation": st.column_config.NumberColumn("Correlation", required=True, min_value=-1,
+                                                             max_value=1, format="%.2f"),
+            },
+            disabled=not monte_carlo,
+            key="correlations_editor",
+        )
+        alert_thresholds = st.text_input("Balance alert thresholds",
+                                         value="0",
+                                         help="Comma-separated balances; alerts list every date the balance crosses them")
+        savings_goal = st.number_input("Savings goal",
+                                       value=0.0,
+                                       min_value=0.0,
+                                       step=1000.0,
+                                       help="Balance to reach by the end of the period, scored as goal coverage on the "
+                                            "plan health (0 disables it)")
+        show_metrics = st.checkbox("Show discounted cashflow metrics (NPV, XIRR, payback)")
+        discount_rate = st.number_input("Annual discount rate (%)",
+                                        value=10.0,
+                                        step=0.5,
+                                        disabled=not show_metrics)
 
         data_config = {
             "name": st.column_config.TextColumn(
@@ -182,8 +1211,95 @@ def main():
                 help="Value that the event generates",
                 width="small",
                 required=True,
+                step=0.01,
+                format="%.2f",
+            ),
+            "delay": st.column_config.NumberColumn(
+                "Payment Delay",
+                help="Days between the event date and the actual payment (e.g. invoice collection)",
+                width="small",
+                min_value=0,
+                step=1,
+            ),
+            "delay_max": st.column_config.NumberColumn(
+                "Max Delay",
+                help="Latest payment in days: the value is collected in weekly parts between the delay and this",
+                width="small",
+                min_value=0,
                 step=1,
             ),
+            "confidence": st.column_config.SelectboxColumn(
+                "Confidence",
+                help="How certain the event is to happen",
+                width="small",
+                options=CONFIDENCE_LEVELS,
+            ),
+            "vat_rate": st.column_config.NumberColumn(
+                "VAT Rate",
+                help="VAT/sales tax rate (%) included in the event value",
+                width="small",
+                min_value=0,
+                max_value=100,
+                format="%.2f%%",
+            ),
+            "currency": st.column_config.TextColumn(
+                "Currency",
+                help="Currency of the event value (defaults to the base currency)",
+                width="small",
+                max_chars=3,
+            ),
+            "account": st.column_config.TextColumn(
+                "Account",
+                help=f"Account the event is paid from/to (defaults to '{DEFAULT_ACCOUNT}')",
+                width="small",
+                max_chars=30,
+            ),
+            "to_account": st.column_config.TextColumn(
+                "Transfer To",
+                help="Makes the event a transfer of its value from the event account to this account",
+                width="small",
+                max_chars=30,
+            ),
+            "distribution": st.column_config.SelectboxColumn(
+                "Distribution",
+                help="Distribution of the event value on Monte Carlo simulations",
+                width="small",
+                options=DISTRIBUTIONS,
+            ),
+            "spread": st.column_config.NumberColumn(
+                "Spread",
+                help="Uncertainty of the value (%): std dev for normal, half-width for uniform/triangular",
+                width="small",
+                min_value=0,
+                format="%.2f%%",
+            ),
+            "probability": st.column_config.NumberColumn(
+                "Probability",
+                help="Chance (%) that the event happens (e.g. 100 minus the default rate of an invoice): "
+                     "expected value on simulations, sampled on Monte Carlo (its VAT is always settled at the "
+                     "expected value)",
+                width="small",
+                min_value=0,
+                max_value=100,
+                format="%.0f%%",
+            ),
+            "branch": st.column_config.TextColumn(
+                "Branch",
+                help="Decision branch of the event (e.g. 'buy car'); events without branch are in every branch",
+                width="small",
+                max_chars=30,
+            ),
+            "exclusive": st.column_config.CheckboxColumn(
+                "Exclusive",
+                help="Active exclusive events with the same name and branch (e.g. successive leases) must not overlap",
+                width="small",
+            ),
+            "state": st.column_config.SelectboxColumn(
+                "State",
+                help="Draft events are only simulated on request, archived events are kept for history",
+                width="small",
+                options=EVENT_STATES,
+            ),
             "obs": st.column_config.TextColumn(
                 "Obs",
                 help="Personal notes about the event",
@@ -192,13 +1308,93 @@ def main():
             ),
         }
         uploadedFile = st.file_uploader("Upload your saved events file",
-                                        type=['csv', 'xlsx'],
+                                        type=[extension[1:] for extension in SCENARIO_EXTENSIONS],
                                         accept_multiple_files=False,
                                         key="eventsUploader",
-                                        help="Upload a CSV/XLSX file with the columns: '" + ", ".join(INPUT_HEADER) + "'")
-        if uploadedFile is not None:
+                                        help="Upload a CSV/XLSX file with the columns: '" + ", ".join(INPUT_HEADER) + "'"
+                                             " or a JSON scenario")
+        if uploadedFile is not None and uploadedFile.file_id != st.session_state.get('uploaded_file_id'):
+            # loaded once per upload, so events added or edited afterwards aren't replaced on every rerun
+            st.session_state.update(load_scenario_file(uploadedFile))
+            st.session_state.uploaded_file_id = uploadedFile.file_id
             st.success('File loaded successfully', icon="🎉")
-            st.session_state.df = load_input_data(uploadedFile)
+        if scenario_files:
+            options = [''] + scenario_files
+            scenario = st.selectbox("Preloaded scenarios",
+                                    options,
+                                    index=options.index(st.session_state.scenario)
+                                    if st.session_state.scenario in options else 0,
+                                    format_func=lambda f: f or 'keep current events')
+            if scenario and scenario != st.session_state.scenario:
+                st.session_state.scenario = scenario
+                st.session_state.update(load_scenario_file(os.path.join(SCENARIOS_DIR, scenario)))
+
+    with st.expander("Quick Add"):
+        with st.form("quick_add_form", clear_on_submit=True):
+            description = st.text_input("Describe an event",
+                                        placeholder="e.g. 1200 rent every month starting March 1st until end of 2027")
+            if st.form_submit_button("Add event") and description:
+                try:
+                    parsed = parse_event(description, TODAY)
+                except ValueError as e:
+                    st.error(f'Could not understand the event: {e}', icon="🚨")
+                else:
+                    df_parsed = setup_input_dataframe(pd.DataFrame([parsed['event']], columns=INPUT_HEADER))
+                    st.session_state.df = pd.concat([st.session_state.df, df_parsed], ignore_index=True)
+                    st.success(f'Added "{parsed["event"]["name"]}" (confidence {parsed["confidence"]:.0%})', icon="🎉")
+                    for ambiguity in parsed['ambiguities']:
+                        st.info(ambiguity)
+
+    with st.expander("Salary Builder"):
+        with st.form("salary_form", clear_on_submit=True):
+            salary_name = st.text_input("Job name", value="Salary", max_chars=40)
+            col1, col2 = st.columns(2)
+            salary_start = col1.date_input("Start date", TOMORROW, format="YYYY.MM.DD")
+            salary_end = col2.date_input("End date", DATE_MAX, format="YYYY.MM.DD")
+            salary_base = col1.number_input("Monthly base salary", value=0.0, min_value=0.0, step=100.0)
+            salary_raise = col2.number_input("Yearly raise (%)", value=0.0, step=0.5)
+            salary_deductions = col1.number_input("Monthly deductions (% of base)", value=0.0, min_value=0.0,
+                                                  max_value=100.0, step=0.5)
+            salary_bonus = col2.number_input("Bonus value", value=0.0, min_value=0.0, step=100.0)
+            salary_bonus_frequency = col2.selectbox("Bonus frequency", ['annual', 'semi-annual', 'quarterly'])
+            if st.form_submit_button("Add salary events") and salary_base > 0:
+                salary_events = expand_salary(salary_name, pd.Timestamp(salary_start), pd.Timestamp(salary_end),
+                                              salary_base, salary_raise, salary_deductions,
+                                              salary_bonus, salary_bonus_frequency)
+                df_salary = setup_input_dataframe(pd.DataFrame(salary_events, columns=INPUT_HEADER))
+                st.session_state.df = pd.concat([st.session_state.df, df_salary], ignore_index=True)
+
+    with st.expander("Import Bank Statement"):
+        statement_file = st.file_uploader("Upload an OFX/QFX, QIF or MT940 statement",
+                                          type=list(PARSERS),
+                                          accept_multiple_files=False,
+                                          key="statementUploader",
+                                          help="Recurring transactions (same payee, similar amount, regular interval) "
+                                               "are proposed as events")
+        if statement_file is not None:
+            check_upload_size(statement_file)
+            content = statement_file.getvalue()
+            try:
+                text = content.decode('utf-8')
+            except UnicodeDecodeError:
+                text = content.decode('latin-1')  # older statement formats are usually in the bank's legacy charset
+            statement_errors = []
+            try:
+                recurring = detect_recurring(parse_statement(statement_file.name, text, statement_errors))
+            except ValueError as e:
+                st.error(f'Invalid statement file: {e}', icon="🚨")
+            else:
+                for error in statement_errors:
+                    st.warning(f'Transaction {error["transaction"]} ignored: {error["error"]}', icon="🚨")
+                if not recurring:
+                    st.warning('No recurring transactions found', icon="🚨")
+                else:
+                    st.dataframe(pd.DataFrame(recurring), hide_index=True, use_container_width=True)
+                    if st.button("Add detected events"):
+                        df_recurring = setup_input_dataframe(pd.DataFrame(
+                            [{k: v for k, v in event.items() if k in INPUT_HEADER} for event in recurring],
+                            columns=INPUT_HEADER))
+                        st.session_state.df = pd.concat([st.session_state.df, df_recurring], ignore_index=True)
 
     df_edited = st.data_editor(
         st.session_state.df,
@@ -211,11 +1407,151 @@ def main():
 
     st.caption("Modify cells above 👆 or even ➕ add rows, and check out the impacts below 👇")
 
-    eventData = df_edited.to_dict(orient="records")
+    with st.expander("What-if Shocks"):
+        "Unexpected events (e.g. job loss for a few months, an unexpected expense) applied on top of your events"
+        apply_shocks = st.checkbox("Apply shocks", value=True)
+        shocks_edited = st.data_editor(
+            st.session_state.shocks,
+            num_rows="dynamic",
+            hide_index=True,
+            use_container_width=True,
+            column_config=data_config,
+            key="shocks_editor",
+        )
+
+    tables = {'df': df_edited, 'shocks': shocks_edited, 'accounts': accounts_edited, 'fx': fx_edited,
+              'fx_shocks': fx_shocks_edited, 'correlations': correlations_edited}
+    st.download_button("Download scenario",
+                       scenario_to_json(tables),
+                       file_name="scenario.json",
+                       mime="application/json",
+                       help="Events, shocks, accounts, FX rates and correlations in a single JSON file")
+
+    if SCENARIOS_DIR and os.path.isdir(SCENARIOS_DIR):
+        with st.expander("Saved Scenarios"):
+            col1, col2 = st.columns(2)
+            scenario_name = col1.text_input("Scenario name",
+                                            value=st.session_state.scenario or '',
+                                            help="Save as .json to keep every table, not only the events")
+            if col1.button("Save scenario"):
+                try:
+                    st.session_state.scenario = save_scenario(tables, SCENARIOS_DIR, scenario_name)
+                    st.success(f'Scenario saved: {st.session_state.scenario}', icon="🎉")
+                except ValueError as e:
+                    st.error(str(e), icon="🚨")
+            scenario_to_delete = col2.selectbox("Scenario", scenario_files)
+            if col2.button("Delete scenario", disabled=not scenario_to_delete):
+                os.remove(os.path.join(SCENARIOS_DIR, scenario_to_delete))
+                if st.session_state.scenario == scenario_to_delete:
+                    st.session_state.scenario = None
+                st.rerun()
+
+    if len(df_edited) + len(shocks_edited) > MAX_EVENTS:
+        st.error(f'Too many events (max {MAX_EVENTS})', icon="🚨")
+        st.stop()
+    problems = validate_events(df_edited.to_dict(orient="records"))
+    if problems:
+        with st.expander(f"Validation ({len(problems)} problems)", expanded=True):
+            "Events with errors are left out of the simulation until they are fixed, warnings are only reported"
+            st.dataframe(pd.DataFrame(problems), hide_index=True, use_container_width=True)
+    invalid_rows = {problem['row'] for problem in problems if problem['severity'] == 'error'}
+
+    eventData = [event for row, event in enumerate(df_edited.to_dict(orient="records"), 1) if row not in invalid_rows]
+    eventData = filter_events_by_state(eventData, include_drafts)
+    eventData = filter_events_by_confidence(eventData, confidence_levels)
+    if apply_shocks:
+        eventData = overlay_shocks(eventData, shocks_edited.to_dict(orient="records"))
+    eventData, branches = split_branches(eventData)
     sim_start, sim_end = [pd.Timestamp(d) for d in simulation_period]
-    cashflows = generate_cashflows(eventData, sim_start, sim_end)
-    df_result = balance_from_cashflows(initial_balance_value, pd.Timestamp(TODAY), cashflows)
-    tab1, tab2 = st.tabs(["Result Graph", "Result Data"])
+    account_balances = {a['account']: a['balance'] for a in accounts_edited.to_dict(orient="records")
+                        if not pd.isnull(a['account']) and not pd.isnull(a['balance'])}
+    credit_line = None
+    if credit_limit > 0:
+        credit_line = {'balance': to_cents(initial_balance_value) + to_cents(account_balances.get(DEFAULT_ACCOUNT, 0)),
+                       'limit': to_cents(credit_limit),
+                       'apr': credit_apr}
+    ladder = None
+    if cover_from_accounts:
+        sources = [{'account': a['account'],
+                    'notice_days': 0 if pd.isnull(a['notice_days']) else int(a['notice_days']),
+                    'penalty': 0 if pd.isnull(a['penalty']) else a['penalty']}
+                   for a in accounts_edited.to_dict(orient="records")
+                   if not pd.isnull(a['account']) and a['account'] not in (DEFAULT_ACCOUNT, CREDIT_LINE_ACCOUNT)]
+        start_balances = {account: to_cents(value) for account, value in account_balances.items()}
+        start_balances[DEFAULT_ACCOUNT] = start_balances.get(DEFAULT_ACCOUNT, 0) + to_cents(initial_balance_value)
+        ladder = {'balances': start_balances, 'sources': sources}
+    inputs_hash = hashlib.sha256(json.dumps([scenario_to_json(tables), sim_start, sim_end, initial_balance_value,
+                                             confidence_levels, include_drafts, apply_shocks, vat_frequency,
+                                             base_currency, credit_limit, credit_apr, cover_from_accounts,
+                                             strict_limits, savings_goal],
+                                            default=str).encode()).hexdigest()
+    run_start = time.perf_counter()
+    fx_rates, fx_shocks = fx_edited.to_dict(orient="records"), fx_shocks_edited.to_dict(orient="records")
+    if cache_results:
+        cashflows, truncated, errors = cached_simulation(
+            inputs_hash, lambda: run_simulation(eventData, sim_start, sim_end, vat_frequency, base_currency, fx_rates,
+                                                fx_shocks, credit_line, ladder, True))
+    else:
+        cashflows, truncated, errors = run_simulation(eventData, sim_start, sim_end, vat_frequency, base_currency,
+                                                      fx_rates, fx_shocks, credit_line, ladder, False)
+    if truncated:
+        st.warning(f'Partial results: more than {MAX_ITEMS} cashflow items, simulated until '
+                   f'{cashflows[-1]["date"] if cashflows else sim_start:%Y.%m.%d}. '
+                   'Shorten the period or use less frequent events', icon="🚨")
+    for error in errors:
+        st.warning(f'Event ignored: {error["name"]}: {error["error"]}', icon="🚨")
+    if not input_order:
+        cashflows = sort_items(cashflows)
+    df_result = balance_from_cashflows(initial_balance_value, pd.Timestamp(TODAY), cashflows, account_balances)
+    limits = {a['account']: a['limit'] for a in accounts_edited.to_dict(orient="records")
+              if not pd.isnull(a['account']) and (strict_limits or not pd.isnull(a['limit']))}
+    limits = {account: 0 if pd.isnull(limit) else limit for account, limit in limits.items()}
+    if credit_limit > 0 or strict_limits:
+        limits[DEFAULT_ACCOUNT] = limits.get(DEFAULT_ACCOUNT, 0)  # the credit line is drawn before going negative
+    infeasible = find_infeasible(df_result.to_dict(orient="records"), limits)
+    health = health_score(df_result.to_dict(orient="records"), savings_goal)
+    # plan health of every change of the inputs in this session, so its trend can be followed while editing
+    if 'health_history' not in st.session_state:
+        st.session_state.health_history = []
+    if not st.session_state.health_history or st.session_state.health_history[-1]['inputs_hash'] != inputs_hash:
+        st.session_state.health_history.append({'run': len(st.session_state.health_history) + 1,
+                                                'inputs_hash': inputs_hash,
+                                                'score': health['score'],
+                                                **health['components']})
+    # reruns with the same inputs (e.g. after changing a chart option) are the same run
+    if AUDIT_LOG and st.session_state.get('audit_hash') != inputs_hash:
+        outcome = 'ok'
+        if infeasible and strict_limits:
+            outcome = 'infeasible'
+        elif truncated:
+            outcome = 'partial'
+        elif errors:
+            outcome = 'errors'
+        written = write_audit_log(AUDIT_LOG, {
+            'time': datetime.now(timezone.utc).isoformat(),
+            'request_hash': inputs_hash,
+            'scenario': st.session_state.scenario,
+            'duration': round(time.perf_counter() - run_start, 3),
+            'outcome': outcome,
+            'health_score': round(health['score'], 1),
+        })
+        if written:
+            st.session_state.audit_hash = inputs_hash
+    if infeasible and strict_limits:
+        st.error('Infeasible plan: account limits exceeded', icon="🚨")
+        st.dataframe(pd.DataFrame(infeasible), hide_index=True, use_container_width=True)
+        st.stop()
+    for over_limit in infeasible:
+        st.warning(f'{over_limit["account"]} limit exceeded on {over_limit["date"]:%Y.%m.%d} '
+                   f'by {over_limit["shortfall"]:.2f}', icon="🚨")
+    penalties = [{'date': cf['date'], 'account': item['account'], 'penalty': from_cents(-item['value'])}
+                 for cf in cashflows for item in cf['items'] if item.get('penalty')]
+    if penalties:
+        with st.expander(f"Early Withdrawal Penalties: {sum(p['penalty'] for p in penalties):,.2f}"):
+            st.dataframe(pd.DataFrame(penalties), hide_index=True, use_container_width=True)
+    alerts = threshold_alerts(df_result.to_dict(orient="records"), parse_thresholds(alert_thresholds))
+    tab1, tab2, tab3, tab4, tab5 = st.tabs(["Result Graph", "Result Data", f"Alerts ({len(alerts)})", "Net Worth",
+                                            "Summary"])
     with tab1:
         base = alt.Chart(df_result).encode(
             alt.X('yearmonthdate(date):T').axis(title='Date'),
@@ -225,12 +1561,279 @@ def main():
                               thickness=10,
                               interpolate='step-after',
                               opacity=0.75).encode(y='balance:Q')
-        chart = (bar + line).properties(height=600)  # .interactive()
+        chart = bar + line
+        account_columns = [col for col in df_result.columns if col.startswith('balance_')]
+        if account_columns:
+            account_lines = base.transform_fold(account_columns, as_=['account', 'account_balance']).mark_line(
+                interpolate='step-after',
+                strokeDash=[4, 2],
+                opacity=0.75).encode(y='account_balance:Q', color='account:N')
+            chart += account_lines
+        chart = chart.properties(height=600)  # .interactive()
         st.altair_chart(chart, theme="streamlit", use_container_width=True)
     with tab2:
-        st.dataframe(df_result,
+        col1, col2 = st.columns(2)
+        fields = col1.multiselect("Fields", list(df_result.columns), default=list(df_result.columns))
+        result_period = col2.date_input("Dates",
+                                        (df_result['date'].min(), df_result['date'].max()),
+                                        format="YYYY.MM.DD")
+        df_view = df_result
+        if len(result_period) == 2:
+            period_begin, period_end = [pd.Timestamp(d) for d in result_period]
+            df_view = df_view[(df_view['date'] >= period_begin) & (df_view['date'] <= period_end)]
+        cycle_window = st.number_input("Group dates within N days as one billing cycle",
+                                       value=0,
+                                       min_value=0,
+                                       max_value=31,
+                                       step=1,
+                                       help="0 shows the exact dates")
+        if cycle_window > 0:
+            st.dataframe(pd.DataFrame(billing_cycles(df_view.to_dict(orient="records"), cycle_window)),
+                         hide_index=True,
+                         use_container_width=True)
+        else:
+            st.dataframe(df_view[fields],
+                         hide_index=True,
+                         use_container_width=True)
+        results_key = json.dumps([inputs_hash, input_order])
+        view_key = json.dumps([results_key, fields, result_period], default=str)
+        st.download_button("Download Parquet",
+                           cached_export(view_key + 'parquet', lambda: to_parquet(df_view[fields])),
+                           file_name="cashflows.parquet",
+                           mime="application/vnd.apache.parquet")
+        st.download_button("Download Arrow",
+                           cached_export(view_key + 'arrow', lambda: to_arrow(df_view[fields])),
+                           file_name="cashflows.arrow",
+                           mime="application/vnd.apache.arrow.file")
+        st.download_button("Download JSON Lines",
+                           cached_export(view_key + 'ndjson', lambda: to_ndjson(df_view[fields])),
+                           file_name="cashflows.jsonl",
+                           mime="application/x-ndjson")
+        st.download_button("Download Excel",
+                           cached_export(results_key + 'xlsx', lambda: to_xlsx(df_result, cashflows)),
+                           file_name="cashflows.xlsx",
+                           mime="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+        st.download_button("Download Calendar",
+                           cached_export(results_key + 'ics', lambda: to_ics(cashflows)),
+                           file_name="cashflows.ics",
+                           mime="text/calendar")
+    with tab3:
+        st.dataframe(pd.DataFrame(alerts, columns=['date', 'threshold', 'direction', 'balance', 'items']),
                      hide_index=True,
                      use_container_width=True)
+    with tab4:
+        st.dataframe(pd.DataFrame(networth_statement(df_result.to_dict(orient="records"))),
+                     hide_index=True,
+                     use_container_width=True)
+    with tab5:
+        summary_frequency = st.radio("Period", ['monthly', 'weekly'], horizontal=True)
+        st.dataframe(pd.DataFrame(period_summary(df_result.to_dict(orient="records"), summary_frequency)),
+                     hide_index=True,
+                     use_container_width=True)
+
+    headline = key_metrics(df_result.to_dict(orient="records"))
+    col1, col2, col3, col4, col5 = st.columns(5)
+    col1.metric("Minimum Balance", f"{headline['min_balance']:,.2f}",
+                help=f"On {headline['min_balance_date']:%Y.%m.%d}")
+    col2.metric("Longest Negative Streak", f"{headline['longest_negative_days']} days")
+    col3.metric("Average Monthly Net", f"{headline['average_monthly_net']:,.2f}")
+    col4.metric("Savings Rate", f"{headline['savings_rate']:.1%}" if headline['savings_rate'] is not None else "n/a")
+    col5.metric("End Balance CAGR",
+                f"{headline['end_balance_cagr']:.1%}" if headline['end_balance_cagr'] is not None else "n/a",
+                help="Annualized growth from the current to the final balance")
+
+    runway_metrics = runway(df_result.to_dict(orient="records"))
+    col1, col2, col3 = st.columns(3)
+    col1.metric("Runway",
+                f"{runway_metrics['runway_months']} months" if runway_metrics['first_negative_date'] else "whole period")
+    col2.metric("First Negative Balance",
+                f"{runway_metrics['first_negative_date']:%Y.%m.%d}" if runway_metrics['first_negative_date'] else "n/a")
+    col3.metric("Monthly Income Needed", f"{runway_metrics['min_monthly_income']:,.2f}",
+                help="Minimum extra monthly income, from today on, to keep the balance non-negative")
+
+    with st.expander(f"Plan Health: {health['score']:.0f}/100"):
+        columns = st.columns(len(health['components']))
+        for column, (component, score) in zip(columns, health['components'].items()):
+            column.metric(component.replace('_', ' ').title(), f"{score:.0f}")
+        if len(st.session_state.health_history) > 1:
+            "Score trend over the runs of this session (scheduled runs are tracked in the audit log)"
+            chart = alt.Chart(pd.DataFrame(st.session_state.health_history)).mark_line(point=True).encode(
+                alt.X('run:O').axis(title='Run'),
+                alt.Y('score:Q').scale(domain=[0, 100]).axis(title='Score'))
+            st.altair_chart(chart.properties(height=200), theme="streamlit", use_container_width=True)
+
+    if show_metrics:
+        metrics = discounted_metrics(df_result.to_dict(orient="records"), discount_rate / 100, pd.Timestamp(TODAY))
+        col1, col2, col3 = st.columns(3)
+        col1.metric("NPV", f"{metrics['npv']:,.2f}")
+        col2.metric("XIRR", f"{metrics['xirr']:.2%}" if metrics['xirr'] is not None else "n/a")
+        col3.metric("Payback Date",
+                    metrics['payback_date'].strftime("%Y.%m.%d") if metrics['payback_date'] else "n/a")
+
+    if branches:
+        st.subheader("Decision Branches")
+        df_branches = []
+        try:
+            for branch, branch_events in branches.items():
+                branch_cashflows = generate_cashflows(branch_events, sim_start, sim_end, vat_frequency,
+                                                      base_currency, fx_edited.to_dict(orient="records"),
+                                                      fx_shocks_edited.to_dict(orient="records"), [], credit_line,
+                                                      ladder)
+                df_branch = balance_from_cashflows(initial_balance_value, pd.Timestamp(TODAY), branch_cashflows,
+                                                   account_balances)
+                df_branches.append(df_branch[['date', 'balance']].assign(branch=branch))
+        except ValueError as e:
+            st.error(f'Decision branches not simulated: {e}', icon="🚨")
+        else:
+            df_branches = pd.concat(df_branches, ignore_index=True)
+            chart = alt.Chart(df_branches).mark_line(interpolate='step-after').encode(
+                alt.X('yearmonthdate(date):T').axis(title='Date'),
+                y='balance:Q',
+                color='branch:N')
+            st.altair_chart(chart.properties(height=400), theme="streamlit", use_container_width=True)
+            st.dataframe(df_branches.groupby('branch')['balance'].agg(['last', 'min']).rename(
+                             columns={'last': 'final balance', 'min': 'min balance'}),
+                         use_container_width=True)
+
+    seed = monte_carlo_seed if monte_carlo_seed is not None else int(np.random.SeedSequence().generate_state(1)[0])
+    if monte_carlo:
+        st.subheader("Monte Carlo Simulation")
+        initial_balance = to_cents(initial_balance_value) + sum(to_cents(v) for v in account_balances.values())
+        correlations = [c for c in correlations_edited.to_dict(orient="records") if not pd.isnull(c['correlation'])]
+        try:
+            balances = simulate_balances(cashflows, initial_balance, monte_carlo_paths, np.random.default_rng(seed),
+                                         correlations, MAX_ITEMS)
+        except ValueError as e:
+            st.error(str(e), icon="🚨")
+            st.stop()
+        percentiles = sorted(monte_carlo_percentiles) or PERCENTILES
+        df_stats = pd.DataFrame.from_records(path_statistics(cashflows, balances, percentiles))
+        st.metric("Probability of negative balance", f"{probability_negative(initial_balance, balances):.1%}")
+        st.caption(f"Seed: {seed}")
+        if not df_stats.empty:
+            low, high = f'p{percentiles[0]}', f'p{percentiles[-1]}'
+            base = alt.Chart(df_stats).encode(alt.X('yearmonthdate(date):T').axis(title='Date'))
+            band = base.mark_area(opacity=0.3, interpolate='step-after').encode(
+                y=alt.Y(f'{low}:Q').axis(title=f'Balance ({low} - {high})'), y2=f'{high}:Q')
+            mean = base.mark_line(color='red', interpolate='step-after').encode(y='mean:Q')
+            st.altair_chart((band + mean).properties(height=400), theme="streamlit", use_container_width=True)
+            st.dataframe(df_stats, hide_index=True, use_container_width=True)
+        "Model assumptions"
+        st.dataframe(pd.DataFrame(distribution_assumptions(cashflows),
+                                  columns=['name', 'distribution', 'spread', 'probability']),
+                     hide_index=True,
+                     use_container_width=True)
+
+    with st.expander("Sensitivity Analysis"):
+        event_names = sorted({event['name'] for event in eventData if not pd.isnull(event['name'])})
+        sensitivity_names = st.multiselect("Events to vary", event_names, max_selections=2)
+        col1, col2 = st.columns(2)
+        sensitivity_range = col1.number_input("Range (± %)", value=20.0, min_value=0.0, step=5.0)
+        sensitivity_steps = col2.number_input("Steps", value=5, min_value=2, max_value=21, step=1)
+        if sensitivity_names:
+            changes = list(np.linspace(-sensitivity_range, sensitivity_range, sensitivity_steps))
+            try:
+                df_sensitivity = pd.DataFrame.from_records(sensitivity_analysis(
+                    eventData, sim_start, sim_end,
+                    to_cents(initial_balance_value) + sum(to_cents(v) for v in account_balances.values()),
+                    {name: changes for name in sensitivity_names},
+                    vat_frequency=vat_frequency,
+                    base_currency=base_currency,
+                    fx_rates=fx_edited.to_dict(orient="records"),
+                    fx_shocks=fx_shocks_edited.to_dict(orient="records"),
+                    credit_line=credit_line,
+                    ladder=ladder))
+            except ValueError as e:
+                st.error(f'Sensitivity analysis not simulated: {e}', icon="🚨")
+            else:
+                st.dataframe(df_sensitivity,
+                             hide_index=True,
+                             use_container_width=True,
+                             column_config={name: st.column_config.NumberColumn(f"{name} (%)", format="%+.1f%%")
+                                            for name in sensitivity_names})
+
+    with st.expander("Retirement Withdrawal"):
+        "Success probability of withdrawing a share of a portfolio every year, adjusted by inflation"
+        returns_model = st.radio("Returns",
+                                 ['lognormal', 'historical'],
+                                 horizontal=True,
+                                 help="Historical resamples whole years (return and inflation) of the series below")
+        col1, col2, col3 = st.columns(3)
+        portfolio = col1.number_input("Portfolio value", value=1000000.0, min_value=0.0, step=10000.0)
+        withdrawal_rate = col2.number_input("Withdrawal rate (%)", value=4.0, min_value=0.0, step=0.25)
+        withdrawal_years = col3.number_input("Years", value=30, min_value=1, max_value=100, step=1)
+        expected_return = col1.number_input("Expected annual return (%)", value=7.0, step=0.5,
+                                            disabled=returns_model == 'historical')
+        return_volatility = col2.number_input("Return volatility (%)", value=15.0, min_value=0.0, step=0.5,
+                                              disabled=returns_model == 'historical')
+        inflation = col3.number_input("Annual inflation (%)", value=3.0, step=0.25)
+        col1, col2 = st.columns(2)
+        inflation_volatility = col1.number_input("Inflation volatility (%)", value=0.0, min_value=0.0, step=0.25,
+                                                 help="Std dev of the yearly inflation changes (0 keeps it fixed)")
+        inflation_reversion = col2.number_input("Inflation mean reversion", value=0.5, min_value=0.0, max_value=1.0,
+                                                step=0.05,
+                                                help="Share of the gap to the average inflation closed every year",
+                                                disabled=inflation_volatility == 0)
+        "Historical returns and inflation by year (inflation is resampled too when every year has it)"
+        history_edited = st.data_editor(
+            st.session_state.history,
+            num_rows="dynamic",
+            hide_index=True,
+            column_config={
+                "year": st.column_config.NumberColumn("Year", step=1),
+                "return": st.column_config.NumberColumn("Return", required=True, format="%.2f%%"),
+                "inflation": st.column_config.NumberColumn("Inflation", format="%.2f%%"),
+            },
+            disabled=returns_model != 'historical',
+            key="history_editor",
+        )
+        history = [h for h in history_edited.to_dict(orient="records") if not pd.isnull(h['return'])]
+        historical_returns = historical_inflation = None
+        if returns_model == 'historical':
+            historical_returns = [h['return'] / 100 for h in history]
+            if history and all(not pd.isnull(h['inflation']) for h in history):
+                historical_inflation = [h['inflation'] / 100 for h in history]
+        if st.button("Simulate withdrawals") and portfolio > 0:
+            if returns_model == 'historical' and not history:
+                st.warning('No historical returns to resample', icon="🚨")
+            else:
+                withdrawal = safe_withdrawal(portfolio, withdrawal_rate / 100, inflation / 100, expected_return / 100,
+                                             return_volatility / 100, withdrawal_years, 10000,
+                                             np.random.default_rng(seed), inflation_volatility / 100,
+                                             inflation_reversion, historical_returns, historical_inflation)
+                st.metric("Success probability", f"{withdrawal['success_probability']:.1%}")
+                st.caption(f"Seed: {seed}")
+                df_withdrawal = pd.DataFrame.from_records(withdrawal['bands'])
+                base = alt.Chart(df_withdrawal).encode(alt.X('year:Q').axis(title='Year'))
+                band = base.mark_area(opacity=0.3).encode(y=alt.Y('p5:Q').axis(title='Portfolio (p5 - p95)'),
+                                                          y2='p95:Q')
+                median = base.mark_line(color='red').encode(y='p50:Q')
+                st.altair_chart((band + median).properties(height=300), theme="streamlit", use_container_width=True)
+
+    with st.expander("Purchase Planner"):
+        col1, col2 = st.columns(2)
+        purchase_value = col1.number_input("Purchase value", value=0.0, min_value=0.0, step=100.0)
+        balance_floor = col2.number_input("Minimum balance to keep", value=0.0, step=100.0)
+        if purchase_value > 0:
+            purchase_date = earliest_affordable_date(df_result.to_dict(orient="records"), purchase_value, balance_floor)
+            if purchase_date:
+                st.success(f'Earliest affordable date: {purchase_date:%Y.%m.%d}', icon="🛒")
+            else:
+                st.warning('The purchase is not affordable within the simulation period', icon="🚨")
+
+    with st.expander("Savings Planner"):
+        col1, col2 = st.columns(2)
+        saving_amount = col1.number_input("Amount to save", value=0.0, min_value=0.0, step=100.0)
+        saving_deadline = col2.date_input("Save by", DATE_MAX, TOMORROW, format="YYYY.MM.DD")
+        saving_contribution = col1.number_input("Contribution", value=0.0, min_value=0.0, step=10.0)
+        saving_frequency = col2.selectbox("Contribution frequency", list(FREQUENCIES), index=2)
+        if saving_amount > 0 and saving_contribution > 0:
+            saving_start = savings_start_date(saving_amount, saving_contribution, pd.Timestamp(saving_deadline),
+                                              saving_frequency, pd.Timestamp(TODAY.date()))
+            if saving_start:
+                st.success(f'Start saving by {saving_start:%Y.%m.%d}', icon="🐷")
+            else:
+                st.warning("The amount can't be saved by that date with this contribution", icon="🚨")
 
 
 if __name__ == "__main__":
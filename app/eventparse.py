@@ -0,0 +1,159 @@
+import calendar
+import re
+from datetime import datetime, timedelta
+
+CURRENCY_SYMBOLS = {'r$': 'BRL', 'us$': 'USD', '$': 'USD', '€': 'EUR', '£': 'GBP'}
+CURRENCY_CODES = ['BRL', 'USD', 'EUR', 'GBP']
+FREQUENCY_PATTERNS = [
+    (r'\b(?:every|each|per) day\b|\bdaily\b', 'daily'),
+    (r'\b(?:every|each|per) week\b|\bweekly\b', 'weekly'),
+    (r'\b(?:every|each) (?:3|three) months\b|\b(?:every|each|per) quarter\b|\bquarterly\b', 'quarterly'),
+    (r'\b(?:every|each) (?:6|six) months\b|\btwice a year\b|\bsemi-?annual(?:ly)?\b', 'semi-annual'),
+    (r'\b(?:every|each|per) month\b|\bmonthly\b', 'monthly'),
+    (r'\b(?:every|each|per) year\b|\byearly\b|\bannual(?:ly)?\b', 'annual'),
+]
+INCOME_WORDS = ['salary', 'income', 'receive', 'received', 'earn', 'earned', 'bonus', 'refund', 'revenue',
+                'dividend', 'dividends', 'paycheck', 'invoice']
+EXPENSE_WORDS = ['pay', 'rent', 'bill', 'expense', 'spend', 'buy', 'fee', 'subscription', 'loan', 'tax',
+                 'insurance', 'mortgage']
+STOP_WORDS = {'a', 'an', 'the', 'of', 'for', 'my', 'on', 'in', 'at', 'and', 'is', 'every', 'each', 'per'}
+MONTHS = {name.lower(): i for i, name in enumerate(calendar.month_name) if name}
+MONTHS.update({name.lower(): i for i, name in enumerate(calendar.month_abbr) if name})
+MONTH_PATTERN = '|'.join(sorted(MONTHS, key=len, reverse=True))
+DATE_PATTERN = (r'(?:today|tomorrow|next month|next year|(?:the )?(?:end|beginning|start) of (?:\d{4}|the year)'
+                r'|\d{4}-\d{2}-\d{2}|\d{1,2}/\d{1,2}/\d{4}'
+                rf'|(?:{MONTH_PATTERN})\.? \d{{1,2}}(?:st|nd|rd|th)?(?:,? \d{{4}})?'
+                rf'|(?:the )?\d{{1,2}}(?:st|nd|rd|th)? (?:of )?(?:{MONTH_PATTERN})\.?(?:,? \d{{4}})?'
+                rf'|(?:{MONTH_PATTERN})\.?(?: \d{{4}})?)')
+START_PATTERN = rf'\b(?:starting(?: on| from| in)?|from|beginning(?: on| in)?|since|on|in)\s+({DATE_PATTERN})\b'
+END_PATTERN = rf'\b(?:until|till|to|through|ending(?: on)?)\s+({DATE_PATTERN})\b'
+AMOUNT_PATTERN = (r'(?P<sign>[-+])?\s*(?P<symbol>r\$|us\$|\$|€|£)?\s*'
+                  r'(?P<number>\d{1,3}(?:[.,]\d{3})+(?:[.,]\d{1,2})?|\d+(?:[.,]\d{1,2})?)(?P<suffix>k)?\b'
+                  r'\s*(?P<code>' + '|'.join(CURRENCY_CODES).lower() + r')?\b')
+CONFIDENCE_PENALTY = 0.15
+
+
+def parse_number(text: str) -> float:
+    # the last separator followed by 1-2 digits is the decimal separator
+    match = re.match(r'^(.*?)[.,](\d{1,2})$', text)
+    if match:
+        return float(re.sub(r'[.,]', '', match.group(1)) + '.' + match.group(2))
+    return float(re.sub(r'[.,]', '', text))
+
+
+def next_date(month: int, day: int, reference: datetime) -> datetime:
+    date = datetime(reference.year, month, min(day, calendar.monthrange(reference.year, month)[1]))
+    if date < reference.replace(hour=0, minute=0, second=0, microsecond=0):
+        date = datetime(reference.year + 1, month, min(day, calendar.monthrange(reference.year + 1, month)[1]))
+    return date
+
+
+def parse_date(text: str, reference: datetime, end: bool, ambiguities: list[str]) -> datetime:
+    text = text.lower().strip()
+    today = reference.replace(hour=0, minute=0, second=0, microsecond=0)
+    if text == 'today':
+        return today
+    if text == 'tomorrow':
+        return today + timedelta(days=1)
+    if text in ('next month', 'next year'):
+        year = today.year + (text == 'next year') + (text == 'next month' and today.month == 12)
+        month = 1 if text == 'next year' else today.month % 12 + 1
+        return datetime(year, month, calendar.monthrange(year, month)[1] if end else 1)
+    match = re.match(r'^(?:the )?(end|beginning|start) of (\d{4}|the year)$', text)
+    if match:
+        year = today.year if match.group(2) == 'the year' else int(match.group(2))
+        return datetime(year, 12, 31) if match.group(1) == 'end' else datetime(year, 1, 1)
+    if re.match(r'^\d{4}-\d{2}-\d{2}$', text):
+        return datetime.strptime(text, '%Y-%m-%d')
+    match = re.match(r'^(\d{1,2})/(\d{1,2})/(\d{4})$', text)
+    if match:
+        first, second, year = (int(g) for g in match.groups())
+        if first <= 12 and second <= 12 and first != second:
+            ambiguities.append(f'"{text}" read as day/month')
+        day, month = (second, first) if first > 12 else (first, second) if second <= 12 else (second, first)
+        return datetime(year, month, day)
+    match = (re.match(rf'^({MONTH_PATTERN})\.? (\d{{1,2}})(?:st|nd|rd|th)?(?:,? (\d{{4}}))?$', text)
+             or re.match(rf'^(?:the )?(\d{{1,2}})(?:st|nd|rd|th)? (?:of )?({MONTH_PATTERN})\.?(?:,? (\d{{4}}))?$', text))
+    if match:
+        groups = match.groups()
+        month, day = (MONTHS[groups[0]], int(groups[1])) if groups[0] in MONTHS else (MONTHS[groups[1]], int(groups[0]))
+        if groups[2]:
+            return datetime(int(groups[2]), month, day)
+        return next_date(month, day, reference)
+    match = re.match(rf'^({MONTH_PATTERN})\.?(?: (\d{{4}}))?$', text)
+    if match:
+        month = MONTHS[match.group(1)]
+        if match.group(2):
+            year = int(match.group(2))
+        else:
+            year = next_date(month, 1 if not end else calendar.monthrange(today.year, month)[1], reference).year
+        return datetime(year, month, calendar.monthrange(year, month)[1] if end else 1)
+    raise ValueError(f'Unrecognized date: {text}')
+
+
+def parse_event(text: str, reference: datetime = None) -> dict:
+    # deterministic parse of phrases like "R$ 1200 rent every month starting March 1st until end of 2027"
+    reference = reference or datetime.now()
+    ambiguities = []
+    rest = ' ' + text.strip().lower() + ' '
+    event = {'name': None, 'start_date': None, 'end_date': None, 'frequency': None, 'value': None, 'currency': None}
+
+    match = re.search(END_PATTERN, rest)
+    if match:
+        event['end_date'] = parse_date(match.group(1), reference, True, ambiguities)
+        rest = rest[:match.start()] + ' ' + rest[match.end():]
+    match = re.search(START_PATTERN, rest)
+    if match:
+        event['start_date'] = parse_date(match.group(1), reference, False, ambiguities)
+        rest = rest[:match.start()] + ' ' + rest[match.end():]
+    else:
+        event['start_date'] = reference.replace(hour=0, minute=0, second=0, microsecond=0)
+        ambiguities.append('no start date, assumed today')
+
+    for pattern, frequency in FREQUENCY_PATTERNS:
+        match = re.search(pattern, rest)
+        if match:
+            event['frequency'] = frequency
+            rest = rest[:match.start()] + ' ' + rest[match.end():]
+            break
+    if not event['frequency']:
+        ambiguities.append('no frequency, assumed one-time event')
+
+    amounts = list(re.finditer(AMOUNT_PATTERN, rest))
+    if not amounts:
+        raise ValueError('No amount found')
+    if len(amounts) > 1:
+        ambiguities.append('several amounts found, used the first one')
+    match = amounts[0]
+    value = parse_number(match.group('number')) * (1000 if match.group('suffix') else 1)
+    symbol, code = match.group('symbol'), match.group('code')
+    if code:
+        event['currency'] = code.upper()
+    elif symbol:
+        event['currency'] = CURRENCY_SYMBOLS[symbol]
+    rest = rest[:match.start()] + ' ' + rest[match.end():]
+
+    words = re.findall(r"[a-zà-ÿ][\w'-]*", rest)
+    if match.group('sign'):
+        sign = -1 if match.group('sign') == '-' else 1
+    elif any(word in INCOME_WORDS for word in words):
+        sign = 1
+    elif any(word in EXPENSE_WORDS for word in words):
+        sign = -1
+    else:
+        sign = -1
+        ambiguities.append('no income/expense keyword, assumed expense')
+    event['value'] = sign * value
+
+    name_words = [word for word in words if word not in STOP_WORDS]
+    if name_words:
+        event['name'] = ' '.join(name_words).capitalize()
+    else:
+        event['name'] = 'Income' if sign > 0 else 'Expense'
+        ambiguities.append('no event name found')
+
+    return {
+        'event': event,
+        'confidence': max(0.0, 1 - CONFIDENCE_PENALTY * len(ambiguities)),
+        'ambiguities': ambiguities,
+    }
@@ -0,0 +1,243 @@
+from datetime import datetime
+
+DAYS_IN_YEAR = 365.0
+XIRR_LOW, XIRR_HIGH = -0.9999, 100.0
+XIRR_TOLERANCE = 1e-7
+XIRR_MAX_ITERATIONS = 200
+TARGET_SAVINGS_RATE = 0.2  # savings rate with full health score
+MIN_CAGR_YEARS = 0.25  # annualizing shorter periods blows small changes up
+
+
+def year_fraction(start: datetime, end: datetime) -> float:
+    return (end - start).days / DAYS_IN_YEAR
+
+
+def npv(cashflows: list[dict], rate: float, start: datetime) -> float:
+    return sum(cf['cashflow'] / (1 + rate) ** year_fraction(start, cf['date']) for cf in cashflows)
+
+
+def xirr(cashflows: list[dict]) -> float:
+    # IRR of irregularly dated cashflows, found by bisection since NPV decreases with the rate
+    values = [cf['cashflow'] for cf in cashflows]
+    if not values or min(values) >= 0 or max(values) <= 0:
+        return None  # IRR needs both inflows and outflows
+    start = cashflows[0]['date']
+    low, high = XIRR_LOW, XIRR_HIGH
+    npv_low = npv(cashflows, low, start)
+    if npv_low * npv(cashflows, high, start) > 0:
+        return None  # no root inside the search interval
+    for _ in range(XIRR_MAX_ITERATIONS):
+        mid = (low + high) / 2
+        npv_mid = npv(cashflows, mid, start)
+        if abs(npv_mid) < XIRR_TOLERANCE or (high - low) / 2 < XIRR_TOLERANCE:
+            return mid
+        if npv_low * npv_mid < 0:
+            high = mid
+        else:
+            low, npv_low = mid, npv_mid
+    return (low + high) / 2
+
+
+def payback_date(cashflows: list[dict]) -> datetime:
+    # date from which the cumulative cashflow stays non-negative after an initial outlay
+    cumulative = 0
+    payback = None
+    was_negative = False
+    for cf in cashflows:
+        cumulative += cf['cashflow']
+        if cumulative < 0:
+            was_negative = True
+            payback = None
+        elif was_negative and payback is None:
+            payback = cf['date']
+    return payback
+
+
+def discounted_metrics(cashflows: list[dict], rate: float, start: datetime) -> dict:
+    return {
+        'npv': npv(cashflows, rate, start),
+        'xirr': xirr(cashflows),
+        'payback_date': payback_date(cashflows),
+    }
+
+
+def earliest_affordable_date(balances: list[dict], amount: float, floor: float = 0) -> datetime:
+    # earliest date a one-time expense keeps every later balance at or above the floor
+    earliest = None
+    min_balance = None
+    for cf in reversed(balances):
+        min_balance = cf['balance'] if min_balance is None else min(min_balance, cf['balance'])
+        if min_balance - amount < floor:
+            break
+        earliest = cf['date']
+    return earliest
+
+
+def months_between(start: datetime, end: datetime) -> int:
+    return (end.year - start.year) * 12 + end.month - start.month - (1 if end.day < start.day else 0)
+
+
+def runway(balances: list[dict]) -> dict:
+    # balances start with the current balance; extra income is assumed monthly from that date on
+    start = balances[0]['date']
+    first_negative = next((cf['date'] for cf in balances if cf['balance'] < 0), None)
+    min_income = max([-cf['balance'] / (months_between(start, cf['date']) + 1)
+                      for cf in balances if cf['balance'] < 0], default=0)
+    return {
+        'first_negative_date': first_negative,
+        'runway_months': months_between(start, first_negative) if first_negative else None,
+        'min_monthly_income': min_income,
+    }
+
+
+def threshold_alerts(balances: list[dict], thresholds: list[float]) -> list[dict]:
+    # every date the balance crosses a threshold, in either direction
+    alerts = []
+    for threshold in sorted(thresholds):
+        below = False
+        for cf in balances:
+            if (cf['balance'] < threshold) != below:
+                below = not below
+                alerts.append({
+                    'date': cf['date'],
+                    'threshold': threshold,
+                    'direction': 'below' if below else 'above',
+                    'balance': cf['balance'],
+                    'items': cf['items'],
+                })
+    return sorted(alerts, key=lambda alert: alert['date'])
+
+
+def billing_cycles(balances: list[dict], window_days: int) -> list[dict]:
+    # dates within the window from the first date of a cycle are grouped in the same cycle
+    cycles = []
+    for cf in balances:
+        if not cycles or (cf['date'] - cycles[-1]['start_date']).days > window_days:
+            cycles.append({'start_date': cf['date'], 'end_date': cf['date'], 'cashflow': 0, 'balance': 0, 'items': ''})
+        cycle = cycles[-1]
+        cycle['end_date'] = cf['date']
+        cycle['cashflow'] = round(cycle['cashflow'] + cf['cashflow'], 2)
+        cycle['balance'] = cf['balance']
+        cycle['items'] = ', '.join(items for items in (cycle['items'], cf['items']) if items)
+    return cycles
+
+
+def networth_statement(balances: list[dict]) -> list[dict]:
+    # month-end balances per account, with negative accounts (e.g. credit lines) reported as liabilities
+    months = {}
+    for cf in balances:
+        months[(cf['date'].year, cf['date'].month)] = cf
+    statement = []
+    for (year, month), cf in sorted(months.items()):
+        accounts = {k: v for k, v in cf.items() if k.startswith('balance_')} or {'balance': cf['balance']}
+        statement.append({
+            'month': f'{year:04d}-{month:02d}',
+            **accounts,
+            'assets': round(sum(v for v in accounts.values() if v > 0), 2),
+            'liabilities': round(sum(v for v in accounts.values() if v < 0), 2),
+            'net_worth': cf['balance'],
+        })
+    return statement
+
+
+def period_summary(balances: list[dict], frequency: str = 'monthly') -> list[dict]:
+    # opening and closing balance, income and expenses per month or ISO week
+    periods = {}
+    for cf in balances:
+        if frequency == 'weekly':
+            year, week, _ = cf['date'].isocalendar()
+            key = f'{year:04d}-W{week:02d}'
+        else:
+            key = f'{cf["date"].year:04d}-{cf["date"].month:02d}'
+        if not key in periods:
+            periods[key] = {'period': key, 'opening_balance': round(cf['balance'] - cf['cashflow'], 2),
+                            'income': 0, 'expenses': 0, 'net': 0, 'closing_balance': 0}
+        summary = periods[key]
+        # item level income and expenses, so a salary and rent on the same date aren't netted
+        summary['income'] = round(summary['income'] + cf['income'], 2)
+        summary['expenses'] = round(summary['expenses'] + cf['expenses'], 2)
+        summary['net'] = round(summary['net'] + cf['cashflow'], 2)
+        summary['closing_balance'] = cf['balance']
+    return list(periods.values())
+
+
+def savings_rate(balances: list[dict]) -> float:
+    income = sum(cf['income'] for cf in balances)
+    expenses = -sum(cf['expenses'] for cf in balances)
+    return (income - expenses) / income if income else None
+
+
+def monthly_net(balances: list[dict]) -> list[float]:
+    months = {}
+    for cf in balances:
+        month = (cf['date'].year, cf['date'].month)
+        months[month] = months.get(month, 0) + cf['cashflow']
+    return list(months.values())
+
+
+def negative_streak(balances: list[dict]) -> int:
+    # longest run of days with a negative balance, up to the last date if still negative
+    longest = 0
+    negative_since = None
+    for cf in balances:
+        if cf['balance'] < 0 and negative_since is None:
+            negative_since = cf['date']
+        elif cf['balance'] >= 0 and negative_since is not None:
+            longest = max(longest, (cf['date'] - negative_since).days)
+            negative_since = None
+    if negative_since is not None:
+        longest = max(longest, (balances[-1]['date'] - negative_since).days + 1)
+    return longest
+
+
+def key_metrics(balances: list[dict]) -> dict:
+    lowest = min(balances, key=lambda cf: cf['balance'])
+    start, end = balances[0], balances[-1]
+    years = year_fraction(start['date'], end['date'])
+    nets = monthly_net(balances)
+    cagr = None
+    if start['balance'] > 0 and end['balance'] > 0 and years >= MIN_CAGR_YEARS:
+        cagr = (end['balance'] / start['balance']) ** (1 / years) - 1
+    return {
+        'min_balance': lowest['balance'],
+        'min_balance_date': lowest['date'],
+        'longest_negative_days': negative_streak(balances),
+        'average_monthly_net': sum(nets) / len(nets),
+        'savings_rate': savings_rate(balances),
+        'end_balance_cagr': cagr,
+    }
+
+
+def health_score(balances: list[dict], goal: float = None) -> dict:
+    # each component scores 0-100 and the plan health is their average
+    period_months = max(months_between(balances[0]['date'], balances[-1]['date']), 1)
+    plan_runway = runway(balances)
+    runway_score = 100.0
+    if plan_runway['first_negative_date']:
+        runway_score = 100 * min(plan_runway['runway_months'] / period_months, 1)
+
+    rate = savings_rate(balances)
+    savings_score = 100 * min(max(rate / TARGET_SAVINGS_RATE, 0), 1) if rate is not None else 0.0
+
+    statement = networth_statement(balances)[-1]
+    debt_score = 0.0 if statement['liabilities'] else 100.0
+    if statement['assets']:
+        debt_score = 100 * (1 - min(-statement['liabilities'] / statement['assets'], 1))
+
+    # std dev of the monthly net cashflow relative to the average monthly income
+    nets = monthly_net(balances)
+    income = sum(cf['income'] for cf in balances) / len(nets)
+    mean = sum(nets) / len(nets)
+    volatility = (sum((net - mean) ** 2 for net in nets) / len(nets)) ** 0.5 / income if income else 1
+    volatility_score = 100 * (1 - min(volatility, 1))
+
+    components = {
+        'runway': runway_score,
+        'savings_rate': savings_score,
+        'debt_ratio': debt_score,
+    }
+    if goal:
+        # share of the savings goal reached by the final balance
+        components['goal_coverage'] = 100 * min(max(balances[-1]['balance'] / goal, 0), 1)
+    components['volatility'] = volatility_score
+    return {'score': sum(components.values()) / len(components), 'components': components}
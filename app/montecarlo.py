@@ -0,0 +1,184 @@
+import numpy as np
+from scipy.special import ndtr
+
+DISTRIBUTIONS = ['normal', 'uniform', 'triangular']
+PERCENTILES = [5, 50, 95]
+
+
+def correlated_normals(names: list[str],
+                       correlations: list[dict],
+                       paths: int,
+                       rng: np.random.Generator,
+                       draws: int = 1) -> dict:
+    # standard normals per path (rows) and draw (columns) for each event, correlated through the Cholesky factor
+    matrix = np.identity(len(names))
+    for correlation in correlations:
+        if correlation['event_a'] in names and correlation['event_b'] in names:
+            i, j = names.index(correlation['event_a']), names.index(correlation['event_b'])
+            if i != j:
+                matrix[i, j] = matrix[j, i] = correlation['correlation']
+    try:
+        cholesky = np.linalg.cholesky(matrix)
+    except np.linalg.LinAlgError:
+        raise ValueError('Correlation matrix is not positive definite')
+    normals = rng.standard_normal((paths, draws, len(names))) @ cholesky.T
+    return {name: normals[:, :, i] for i, name in enumerate(names)}
+
+
+def sample_values(items: list[dict],
+                  paths: int,
+                  rng: np.random.Generator,
+                  correlations: list[dict] = None,
+                  dates: np.ndarray = None) -> np.ndarray:
+    # spread is a percentage of the item value: std dev for normal, half-width for uniform/triangular
+    probabilities = np.array([item.get('probability', 1.0) for item in items], dtype=float)
+    values = np.array([item['value'] for item in items], dtype=float)
+    values = np.divide(values, probabilities, out=np.zeros_like(values), where=probabilities > 0)  # undo expected value
+    scales = np.abs(values) * np.array([item.get('spread', 0) for item in items], dtype=float) / 100
+    # every occurrence draws its own normal; correlated events draw a correlated vector per date (the index in dates)
+    normals = rng.standard_normal((paths, len(items)))
+    correlated = sorted({name for c in correlations or [] for name in (c['event_a'], c['event_b'])}
+                        & {item['name'] for item in items if 'distribution' in item})
+    if correlated:
+        dates = np.zeros(len(items), dtype=int) if dates is None else np.asarray(dates)
+        draw_dates, draw_index = np.unique(dates, return_inverse=True)
+        event_normals = correlated_normals(correlated, correlations, paths, rng, len(draw_dates))
+        for j, item in enumerate(items):
+            if item['name'] in event_normals:
+                normals[:, j] = event_normals[item['name']][:, draw_index[j]]
+    uniforms = ndtr(normals)
+    samples = np.tile(values, (paths, 1))
+    for distribution in DISTRIBUTIONS:
+        mask = np.array([item.get('distribution') == distribution for item in items], dtype=bool) & (scales > 0)
+        if not mask.any():
+            continue
+        scale = scales[mask]
+        if distribution == 'normal':
+            samples[:, mask] += scale * normals[:, mask]
+        elif distribution == 'uniform':
+            samples[:, mask] += scale * (2 * uniforms[:, mask] - 1)
+        elif distribution == 'triangular':
+            u = uniforms[:, mask]
+            samples[:, mask] += scale * np.where(u < 0.5, np.sqrt(2 * u) - 1, 1 - np.sqrt(2 * (1 - u)))
+    happens = rng.random((paths, len(items))) < probabilities
+    return samples * happens
+
+
+def is_uncertain(item: dict) -> bool:
+    return 'distribution' in item or 'probability' in item
+
+
+def simulate_balances(cashflows: list,
+                      initial_balance: int,
+                      paths: int,
+                      rng: np.random.Generator,
+                      correlations: list[dict] = None,
+                      max_samples: int = None) -> np.ndarray:
+    # balances per path (rows) and cashflow date (columns), in cents; certain items are the same on every path
+    certain = np.array([sum(item['value'] for item in cf['items'] if not is_uncertain(item)) for cf in cashflows],
+                       dtype=float)
+    uncertain = [(i, item) for i, cf in enumerate(cashflows) for item in cf['items'] if is_uncertain(item)]
+    if max_samples and paths * len(uncertain) > max_samples:
+        raise ValueError(f'Too many samples: {len(uncertain)} uncertain cashflow items on {paths} paths '
+                         f'(max {max_samples}). Use fewer paths or a shorter period')
+    per_date = np.tile(certain, (paths, 1))
+    if uncertain:
+        date_index = np.array([i for i, _ in uncertain])
+        samples = sample_values([item for _, item in uncertain], paths, rng, correlations, date_index)
+        np.add.at(per_date, (slice(None), date_index), samples)
+    return initial_balance + np.cumsum(per_date, axis=1)
+
+
+def path_statistics(cashflows: list, balances: np.ndarray, percentiles: list[int] = PERCENTILES) -> list[dict]:
+    # per date: requested percentiles, mean, std dev and probability of having been negative up to the date
+    if not cashflows:
+        return []
+    bands = np.percentile(balances, percentiles, axis=0) / 100
+    means = balances.mean(axis=0) / 100
+    stds = balances.std(axis=0) / 100
+    ruin = (np.minimum.accumulate(balances, axis=1) < 0).mean(axis=0)
+    return [{'date': cf['date'],
+             **{f'p{p}': bands[j][i] for j, p in enumerate(percentiles)},
+             'mean': means[i],
+             'std': stds[i],
+             'ruin_probability': ruin[i]}
+            for i, cf in enumerate(cashflows)]
+
+
+def distribution_assumptions(cashflows: list) -> list[dict]:
+    # model assumptions of the uncertain events, echoed back with the results
+    assumptions = {}
+    for cf in cashflows:
+        for item in cf['items']:
+            if 'distribution' in item or 'probability' in item:
+                assumptions[item['name']] = {
+                    'name': item['name'],
+                    'distribution': item.get('distribution'),
+                    'spread': item.get('spread'),
+                    'probability': item.get('probability', 1.0),
+                }
+    return list(assumptions.values())
+
+
+def probability_negative(initial_balance: int, balances: np.ndarray) -> float:
+    if initial_balance < 0:
+        return 1.0
+    if balances.size == 0:
+        return 0.0
+    return float((balances.min(axis=1) < 0).mean())
+
+
+def inflation_paths(mean: float,
+                    volatility: float,
+                    reversion: float,
+                    years: int,
+                    paths: int,
+                    rng: np.random.Generator) -> np.ndarray:
+    # yearly rates per path (rows); every year closes the reversion share of the gap to the mean (AR(1))
+    rates = np.empty((paths, years))
+    rate = np.full(paths, float(mean))
+    shocks = rng.normal(0, volatility, (paths, years))
+    for year in range(years):
+        rates[:, year] = rate
+        rate = rate + reversion * (mean - rate) + shocks[:, year]
+    return rates
+
+
+def safe_withdrawal(portfolio: float,
+                    withdrawal_rate: float,
+                    inflation: float,
+                    mean_return: float,
+                    volatility: float,
+                    years: int,
+                    paths: int,
+                    rng: np.random.Generator,
+                    inflation_volatility: float = 0,
+                    inflation_reversion: float = 0.5,
+                    historical_returns: list[float] = None,
+                    historical_inflation: list[float] = None) -> dict:
+    # yearly withdrawals of a fixed share of the initial portfolio, adjusted by inflation, over lognormal returns
+    # or over whole years resampled from a historical series (bootstrap), keeping each year's return and inflation
+    if historical_returns:
+        sampled = rng.integers(0, len(historical_returns), (paths, years))
+        growth = 1 + np.asarray(historical_returns, dtype=float)[sampled]
+    else:
+        sigma = np.sqrt(np.log(1 + (volatility / (1 + mean_return)) ** 2))
+        mu = np.log(1 + mean_return) - sigma ** 2 / 2
+        growth = np.exp(rng.normal(mu, sigma, (paths, years)))
+    rates = np.full((paths, years), float(inflation))
+    if historical_returns and historical_inflation:
+        rates = np.asarray(historical_inflation, dtype=float)[sampled]
+    elif inflation_volatility:
+        rates = inflation_paths(inflation, inflation_volatility, inflation_reversion, years, paths, rng)
+    withdrawals = portfolio * withdrawal_rate * np.cumprod(np.hstack([np.ones((paths, 1)), 1 + rates[:, :-1]]), axis=1)
+    balances = np.empty((paths, years))
+    balance = np.full(paths, float(portfolio))
+    for year in range(years):
+        balance = np.maximum(balance - withdrawals[:, year], 0) * growth[:, year]
+        balances[:, year] = balance
+    bands = np.percentile(balances, PERCENTILES, axis=0)
+    return {
+        'success_probability': float((balances[:, -1] > 0).mean()),
+        'bands': [{'year': year + 1, **{f'p{p}': bands[j][year] for j, p in enumerate(PERCENTILES)}}
+                  for year in range(years)],
+    }
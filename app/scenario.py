@@ -0,0 +1,34 @@
+import json
+
+SCHEMA_VERSION = 1
+SECTIONS = ['events', 'shocks', 'accounts', 'fx', 'fx_shocks', 'correlations']
+
+
+def migrate_v0(scenario: list) -> dict:
+    # version 0 is a bare list of events, as exported before the scenario format existed
+    return {'version': 1, 'events': scenario}
+
+
+MIGRATIONS = {0: migrate_v0}
+
+
+def load_scenario(text: str) -> dict:
+    # older versions are migrated one step at a time up to the current schema
+    scenario = json.loads(text)
+    if isinstance(scenario, list):
+        version = 0
+    elif isinstance(scenario, dict) and isinstance(scenario.get('version'), int):
+        version = scenario['version']
+    else:
+        raise ValueError('Missing scenario version')
+    if version > SCHEMA_VERSION:
+        raise ValueError(f'Scenario version {version} is newer than the supported version {SCHEMA_VERSION}')
+    while version < SCHEMA_VERSION:
+        scenario = MIGRATIONS[version](scenario)
+        version = scenario['version']
+    return {section: scenario.get(section) or [] for section in SECTIONS}
+
+
+def dump_scenario(sections: dict) -> str:
+    return json.dumps({'version': SCHEMA_VERSION, **{section: sections.get(section, []) for section in SECTIONS}},
+                      indent=2)
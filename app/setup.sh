@@ -1,11 +1,11 @@
 #!/bin/bash
 mkdir -p ~/.streamlit/
-echo -e '
+echo -e "
 [theme]
-base="dark"
+base=\"dark\"
 [server]
 runOnSave=true
-maxUploadSize=2000
+maxUploadSize=${CASHFLOWSIM_MAX_UPLOAD_MB:-5}
 [browser]
 gatherUsageStats = true
-' > ~/.streamlit/config.toml
+" > ~/.streamlit/config.toml
@@ -0,0 +1,172 @@
+import re
+from datetime import datetime
+
+OFX_TRANSACTION_PATTERN = r'<STMTTRN>(.*?)(?:</STMTTRN>|(?=<STMTTRN>|</BANKTRANLIST>))'
+OFX_FIELD_PATTERN = r'<{}>([^<\r\n]*)'
+QIF_DATE_PATTERN = r"^(\d{1,2})/\s*(\d{1,2})(?:/|')\s*(\d{2,4})$"
+QIF_ISO_DATE_PATTERN = r'^(\d{4})-(\d{1,2})-(\d{1,2})$'
+MT940_TRANSACTION_PATTERN = r':61:(\d{6})(?:\d{4})?(RC|RD|C|D)[A-Z]?(\d+,\d{0,2})[^\n]*\n?(?::86:((?:(?!\n:\d{2}[A-Z]?:)[\s\S])*))?'
+# expected interval in days and accepted deviation of each interval between occurrences
+RECURRENCE_INTERVALS = [
+    ('weekly', 7, 1),
+    ('monthly', 30.4, 4),
+    ('quarterly', 91.3, 7),
+    ('semi-annual', 182.6, 10),
+    ('annual', 365.25, 15),
+]
+MIN_OCCURRENCES = 3
+AMOUNT_TOLERANCE = 0.1  # relative deviation from the median amount
+
+
+def ofx_field(block: str, name: str) -> str:
+    match = re.search(OFX_FIELD_PATTERN.format(name), block, re.IGNORECASE)
+    return match.group(1).strip() if match else None
+
+
+def parse_amount(text: str) -> float:
+    # the last separator is the decimal one (1,234.56 or 1.234,56), unless a single kind of separator has 3 digits
+    # after it, which makes it a thousands separator (1,234 or 1.234.567)
+    text = re.sub(r'\s', '', text)
+    decimal = max(text.rfind(','), text.rfind('.'))
+    if decimal < 0 or (len(set(re.findall(r'[.,]', text))) == 1 and len(text) - decimal == 4):
+        return float(re.sub(r'[.,]', '', text))
+    return float(re.sub(r'[.,]', '', text[:decimal]) + '.' + text[decimal + 1:])
+
+
+def add_transaction(transactions: list[dict], number: int, parse, errors: list = None):
+    # a failing transaction is skipped and reported on errors (if given) instead of failing the whole statement
+    try:
+        transactions.append(parse())
+    except ValueError as e:
+        if errors is None:
+            raise
+        errors.append({'transaction': number, 'error': str(e)})
+
+
+def parse_ofx(text: str, errors: list = None) -> list[dict]:
+    # OFX 1.x (SGML, closing tags optional) and 2.x (XML) statements; QFX is OFX with extra Quicken tags
+    transactions = []
+    for number, block in enumerate(re.findall(OFX_TRANSACTION_PATTERN, text, re.IGNORECASE | re.DOTALL), 1):
+        date, amount = ofx_field(block, 'DTPOSTED'), ofx_field(block, 'TRNAMT')
+        if not date or not amount:
+            continue
+        add_transaction(transactions, number, lambda: {
+            'date': datetime.strptime(date[:8], '%Y%m%d'),
+            'payee': ofx_field(block, 'NAME') or ofx_field(block, 'PAYEE') or ofx_field(block, 'MEMO') or '',
+            'amount': parse_amount(amount),
+        }, errors)
+    return sorted(transactions, key=lambda t: t['date'])
+
+
+def parse_qif_date(text: str) -> datetime:
+    # Quicken writes month/day, with a quote before 2 digit years since 2000 (e.g. 1/15'25); other tools write ISO dates
+    match = re.match(QIF_ISO_DATE_PATTERN, text.strip())
+    if match:
+        year, month, day = (int(g) for g in match.groups())
+        return datetime(year, month, day)
+    match = re.match(QIF_DATE_PATTERN, text.strip())
+    if not match:
+        raise ValueError(f'Unrecognized date: {text}')
+    month, day, year = (int(g) for g in match.groups())
+    return datetime(year if year > 99 else 2000 + year, month, day)
+
+
+def parse_qif(text: str, errors: list = None) -> list[dict]:
+    # one field per line (D date, T amount, P payee, M memo), records ending with ^
+    transactions = []
+    record = {}
+    number = 0
+    for line in text.splitlines():
+        line = line.strip()
+        if not line or line.startswith('!'):
+            continue
+        if line == '^':
+            number += 1
+            if 'D' in record and 'T' in record:
+                add_transaction(transactions, number, lambda: {
+                    'date': parse_qif_date(record['D']),
+                    'payee': record.get('P') or record.get('M') or '',
+                    'amount': parse_amount(record['T']),
+                }, errors)
+            record = {}
+        else:
+            record[line[0]] = line[1:].strip()
+    return sorted(transactions, key=lambda t: t['date'])
+
+
+def parse_mt940(text: str, errors: list = None) -> list[dict]:
+    # :61: statement lines (value date YYMMDD, debit/credit mark, amount with decimal comma) with :86: details
+    transactions = []
+    matches = re.findall(MT940_TRANSACTION_PATTERN, text.replace('\r\n', '\n'))
+    for number, (date, mark, amount, details) in enumerate(matches, 1):
+        sign = -1 if mark in ('D', 'RC') else 1  # RC/RD are reversals of credits/debits
+        add_transaction(transactions, number, lambda: {
+            'date': datetime.strptime(date, '%y%m%d'),
+            'payee': ' '.join(details.split()),
+            'amount': sign * float(amount.replace(',', '.')),
+        }, errors)
+    return sorted(transactions, key=lambda t: t['date'])
+
+
+PARSERS = {
+    'ofx': parse_ofx,
+    'qfx': parse_ofx,
+    'qif': parse_qif,
+    'sta': parse_mt940,
+    'mt940': parse_mt940,
+}
+
+
+def parse_statement(file_name: str, text: str, errors: list = None) -> list[dict]:
+    # the parser is chosen by the file extension; every parser returns date, payee and amount per transaction
+    extension = file_name.rsplit('.', 1)[-1].lower()
+    if extension not in PARSERS:
+        raise ValueError(f'Unsupported statement format: {extension}')
+    return PARSERS[extension](text, errors)
+
+
+def clean_payee(payee: str) -> str:
+    # drop digits and punctuation so "NETFLIX.COM 12345" and "NETFLIX.COM 67890" match
+    return ' '.join(re.sub(r'[\d\W_]+', ' ', payee).split())
+
+
+def normalize_payee(payee: str) -> str:
+    return clean_payee(payee).lower()
+
+
+def median(values: list[float]) -> float:
+    values = sorted(values)
+    middle = len(values) // 2
+    return values[middle] if len(values) % 2 else (values[middle - 1] + values[middle]) / 2
+
+
+def detect_recurring(transactions: list[dict]) -> list[dict]:
+    # same payee, similar amount and regular interval between the dates
+    payees = {}
+    for transaction in transactions:
+        key = (normalize_payee(transaction['payee']), transaction['amount'] > 0)
+        if not key in payees:
+            payees[key] = []
+        payees[key].append(transaction)
+    events = []
+    for _, payee_transactions in sorted(payees.items()):
+        if len(payee_transactions) < MIN_OCCURRENCES:
+            continue
+        amount = median([t['amount'] for t in payee_transactions])
+        similar = [t for t in payee_transactions
+                   if abs(t['amount'] - amount) <= abs(amount) * AMOUNT_TOLERANCE]
+        if len(similar) < MIN_OCCURRENCES:
+            continue
+        intervals = [(b['date'] - a['date']).days for a, b in zip(similar, similar[1:])]
+        for frequency, days, deviation in RECURRENCE_INTERVALS:
+            if all(abs(interval - days) <= deviation for interval in intervals):
+                events.append({
+                    'name': clean_payee(similar[-1]['payee']),
+                    'start_date': similar[0]['date'],
+                    'frequency': frequency,
+                    'value': round(median([t['amount'] for t in similar]), 2),
+                    'occurrences': len(similar),
+                    'last_date': similar[-1]['date'],
+                })
+                break
+    return events
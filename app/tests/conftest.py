@@ -0,0 +1,17 @@
+import os
+import sys
+import pandas as pd
+import pytest
+
+# the app modules are imported by name, as streamlit runs app.py from its directory
+sys.path.insert(0, os.path.dirname(os.path.dirname(os.path.abspath(__file__))))
+
+
+@pytest.fixture
+def make_event():
+    def make(**fields) -> dict:
+        event = {'name': 'event', 'start_date': pd.Timestamp(2025, 1, 1), 'end_date': pd.NaT, 'frequency': 'monthly',
+                 'value': 100.0}
+        event.update(fields)
+        return event
+    return make
@@ -0,0 +1,159 @@
+import os
+import sys
+import tracemalloc
+import pandas as pd
+import pytest
+from dateutil.relativedelta import relativedelta
+from app import (balance_from_cashflows, expand_event, generate_cashflows, iter_cashflows, merge_cashflows, sort_items,
+                 sum_by_account)
+
+BEGIN, END = pd.Timestamp(2025, 1, 1), pd.Timestamp(2025, 3, 31)
+YEAR_END = pd.Timestamp(2025, 12, 31)
+HORIZONS = [1, 10, 50]  # years
+# scales over 1M cashflow items (quarterly events) take minutes and GBs, so they only run on request
+FULL_SCALE = os.environ.get('CASHFLOWSIM_BENCHMARK_FULL')
+SCALES = [pytest.param(count, years, marks=pytest.mark.skipif(
+              count * years * 4 > 1000000 and not FULL_SCALE, reason='set CASHFLOWSIM_BENCHMARK_FULL to run'))
+          for count in [1000, 10000, 100000] for years in HORIZONS]
+MEMORY_PER_ITEM = 2048  # bytes of peak allocation per generated cashflow item
+
+
+def test_expand_event(benchmark, make_event):
+    event = make_event(frequency='daily')
+    occurrences = benchmark(lambda: list(expand_event(event, BEGIN, YEAR_END)))
+    assert len(occurrences) == 365
+
+
+def test_merge_cashflows(benchmark, make_event):
+    streams = [list(expand_event(make_event(name=f'event {i}', start_date=pd.Timestamp(2025, 1, 1 + i % 28)),
+                                 BEGIN, YEAR_END))
+               for i in range(10000)]
+    cashflows = benchmark(lambda: list(merge_cashflows(streams, BEGIN, YEAR_END, 'quarterly')))
+    assert sum(len(cf['items']) for cf in cashflows) == 12 * 10000
+
+
+def test_full_simulation(benchmark, make_event):
+    events = [make_event(name=f'event {i}', start_date=pd.Timestamp(2025, 1, 1 + i % 28), value=i % 100 - 50,
+                         frequency=['daily', 'weekly', 'monthly'][i % 3], vat_rate=20 * (i % 2))
+              for i in range(1000)]
+
+    def simulate():
+        cashflows = sort_items(generate_cashflows(events, BEGIN, YEAR_END, 'quarterly'))
+        return balance_from_cashflows(1000, BEGIN, cashflows)
+
+    df = benchmark.pedantic(simulate, rounds=3, iterations=1)
+    assert df['date'].is_monotonic_increasing
+
+
+def test_generate_cashflows_100k_events(benchmark, make_event):
+    # one event per day of the month and value, 3 monthly occurrences each
+    events = [make_event(name=f'event {i}', start_date=pd.Timestamp(2025, 1, 1 + i % 28), value=i % 1000 - 500)
+              for i in range(100000)]
+    cashflows = benchmark.pedantic(generate_cashflows, args=(events, BEGIN, END), rounds=1, iterations=1)
+    assert sum(len(cf['items']) for cf in cashflows) == 3 * (100000 - 100)  # zero values generate nothing
+
+
+def loop_balances(initial_balances: dict, cashflows: list) -> list[dict]:
+    # the per-date loop replaced by the cumulative sums of balance_from_cashflows, kept as its baseline
+    balances = dict(initial_balances)
+    running_balance = sum(balances.values())
+    rows = []
+    for cf in cashflows:
+        running_balance += cf['cashflow']
+        for account, value in sum_by_account(cf['items']).items():
+            balances[account] = balances.get(account, 0) + value
+        rows.append({'balance': running_balance,
+                     **{f'balance_{account}': value for account, value in balances.items()}})
+    return rows
+
+
+@pytest.fixture(scope='module')
+def account_cashflows() -> list:
+    # income and expenses on the main account and transfers to 2 other accounts
+    events = [{'name': f'event {i}', 'start_date': pd.Timestamp(2025, 1, 1 + i % 28), 'end_date': pd.NaT,
+               'frequency': ['daily', 'weekly', 'monthly'][i % 3], 'value': i % 100 - 50,
+               'to_account': [None, 'savings', 'broker'][i % 3]}
+              for i in range(1000)]
+    return generate_cashflows(events, BEGIN, YEAR_END)
+
+
+@pytest.mark.benchmark(group='balances')
+def test_balances_vectorized(benchmark, account_cashflows):
+    df = benchmark(balance_from_cashflows, 1000, BEGIN, account_cashflows, {'savings': 500})
+    expected = loop_balances({'main': 100000, 'savings': 50000}, account_cashflows)
+    for column in ['balance', 'balance_main', 'balance_savings', 'balance_broker']:
+        assert df[column].tolist()[1:] == [row.get(column, 0) / 100 for row in expected]
+
+
+@pytest.mark.benchmark(group='balances')
+def test_balances_loop(benchmark, account_cashflows):
+    rows = benchmark(loop_balances, {'main': 100000, 'savings': 50000}, account_cashflows)
+    assert len(rows) == len(account_cashflows)
+
+
+def horizon_end(years: int) -> pd.Timestamp:
+    return BEGIN + relativedelta(years=+years, days=-1)
+
+
+def scale_events(count: int) -> list[dict]:
+    # quarterly income and expenses spread over the months and days, half of them with VAT
+    return [{'name': f'event {i}', 'start_date': pd.Timestamp(2025, 1 + i % 3, 1 + i % 28), 'end_date': pd.NaT,
+             'frequency': 'quarterly', 'value': (i % 1000 + 1) * (-1) ** i, 'vat_rate': 20 * (i % 2)}
+            for i in range(count)]
+
+
+@pytest.mark.benchmark(group='scale-expand')
+@pytest.mark.parametrize('years', HORIZONS)
+def test_expand_event_scale(benchmark, make_event, years):
+    event = make_event(frequency='daily')
+    occurrences = benchmark(lambda: list(expand_event(event, BEGIN, horizon_end(years))))
+    assert len(occurrences) == (horizon_end(years) - BEGIN).days + 1
+
+
+@pytest.mark.benchmark(group='scale-merge')
+@pytest.mark.parametrize('count, years', SCALES)
+def test_merge_cashflows_scale(benchmark, count, years):
+    streams = [list(expand_event(event, BEGIN, horizon_end(years))) for event in scale_events(count)]
+    cashflows = benchmark.pedantic(lambda: list(merge_cashflows(streams, BEGIN, horizon_end(years), 'quarterly')),
+                                   rounds=1, iterations=1)
+    # every occurrence plus one VAT settlement per quarter
+    assert sum(len(cf['items']) for cf in cashflows) == count * years * 4 + years * 4
+
+
+@pytest.mark.benchmark(group='scale-simulation')
+@pytest.mark.parametrize('count, years', SCALES)
+def test_full_simulation_scale(benchmark, count, years):
+    events = scale_events(count)
+
+    def simulate():
+        cashflows = generate_cashflows(events, BEGIN, horizon_end(years), 'quarterly', max_items=sys.maxsize)
+        return balance_from_cashflows(1000, BEGIN, sort_items(cashflows))
+
+    df = benchmark.pedantic(simulate, rounds=1, iterations=1)
+    assert df['date'].is_monotonic_increasing
+
+
+def peak_memory(function) -> int:
+    tracemalloc.start()
+    try:
+        function()
+        return tracemalloc.get_traced_memory()[1]
+    finally:
+        tracemalloc.stop()
+
+
+@pytest.mark.parametrize('count', [1000, 10000])
+def test_generate_cashflows_memory_budget(count):
+    events = scale_events(count)
+    peak = peak_memory(lambda: generate_cashflows(events, BEGIN, YEAR_END, 'quarterly'))
+    assert peak < MEMORY_PER_ITEM * count * 4
+
+
+def test_streamed_cashflows_memory_does_not_grow_with_the_horizon():
+    events = scale_events(200)
+
+    def consume(years: int):
+        for _ in iter_cashflows(events, BEGIN, horizon_end(years), 'quarterly'):
+            pass
+
+    assert peak_memory(lambda: consume(50)) < 1.5 * peak_memory(lambda: consume(10))
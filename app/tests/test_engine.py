@@ -0,0 +1,199 @@
+import pandas as pd
+from app import (apply_credit_line, find_infeasible, generate_cashflows, get_dates_backward, iter_cashflows,
+                 iter_cashflows_cached, run_simulation, savings_start_date, split_delay, sum_by_account,
+                 take_cashflows, validate_events)
+
+T = pd.Timestamp
+
+
+def settlements(cashflows: list) -> list[tuple]:
+    return [(cf['date'], item['value']) for cf in cashflows for item in cf['items'] if item['name'] == 'VAT settlement']
+
+
+def test_vat_settled_at_calendar_quarter_ends(make_event):
+    events = [make_event(name='sales', start_date=T(2025, 2, 15), value=120.0, vat_rate=20.0),
+              make_event(name='laptop', start_date=T(2025, 6, 30), frequency=None, value=-60.0, vat_rate=20.0)]
+    cashflows = generate_cashflows(events, T(2025, 2, 10), T(2025, 9, 30), 'quarterly')
+    # VAT of items on a period end belongs to that period
+    assert settlements(cashflows) == [(T(2025, 3, 31), -4000), (T(2025, 6, 30), -5000), (T(2025, 9, 30), -6000)]
+
+
+def test_vat_settlement_dates_do_not_depend_on_the_simulation_start(make_event):
+    events = [make_event(name='sales', start_date=T(2025, 1, 25), value=120.0, vat_rate=20.0)]
+    for begin in [T(2025, 1, 1), T(2025, 1, 20)]:
+        dates = [date for date, _ in settlements(generate_cashflows(events, begin, T(2025, 4, 30), 'monthly'))]
+        assert dates == [T(2025, 1, 31), T(2025, 2, 28), T(2025, 3, 31), T(2025, 4, 30)]
+
+
+def test_dates_backward_do_not_drift_at_month_ends():
+    assert get_dates_backward(T(2025, 3, 31), 'monthly', T(2024, 12, 1)) == [T(2025, 3, 31), T(2025, 2, 28),
+                                                                             T(2025, 1, 31), T(2024, 12, 31)]
+    assert get_dates_backward(T(2025, 3, 31), None, T(2024, 12, 1)) == [T(2025, 3, 31)]
+
+
+def test_savings_start_date():
+    # 1000 in contributions of 300 needs 4 of them, the first 3 months before the deadline
+    assert savings_start_date(1000, 300, T(2025, 12, 31), 'monthly', T(2025, 1, 1)) == T(2025, 9, 30)
+    assert savings_start_date(900, 300, T(2025, 12, 31), 'monthly', T(2025, 1, 1)) == T(2025, 10, 31)
+    assert savings_start_date(1000, 300, T(2025, 12, 31), 'monthly', T(2025, 10, 1)) is None
+
+
+def items_on(cashflows: list, date: pd.Timestamp) -> list[tuple]:
+    return [(item['name'], item['value'], item['account']) for cf in cashflows if cf['date'] == date
+            for item in cf['items']]
+
+
+def test_shortfalls_covered_from_the_cheapest_account(make_event):
+    events = [make_event(name='rent', start_date=T(2025, 2, 1), frequency=None, value=-300.0),
+              make_event(name='repairs', start_date=T(2025, 5, 1), frequency=None, value=-300.0)]
+    ladder = {'balances': {'main': 10000, 'savings': 10000, 'deposit': 100000},
+              'sources': [{'account': 'deposit', 'notice_days': 90, 'penalty': 10.0},
+                          {'account': 'savings', 'notice_days': 0, 'penalty': 0}]}
+    cashflows = generate_cashflows(events, T(2025, 1, 1), T(2025, 6, 30), ladder=ladder)
+    # the deposit is only free after its notice period, so savings go first and the deposit pays a penalty
+    assert items_on(cashflows, T(2025, 2, 1)) == [
+        ('rent', -30000, 'main'),
+        ('Withdrawal from savings', 10000, 'main'), ('Withdrawal from savings', -10000, 'savings'),
+        ('Withdrawal from deposit', 10000, 'main'), ('Withdrawal from deposit', -10000, 'deposit'),
+        ('Early withdrawal penalty (deposit)', -1000, 'deposit'),
+    ]
+    assert cashflows[0]['cashflow'] == -31000
+    assert items_on(cashflows, T(2025, 5, 1)) == [
+        ('repairs', -30000, 'main'),
+        ('Withdrawal from deposit', 30000, 'main'), ('Withdrawal from deposit', -30000, 'deposit'),
+    ]
+
+
+def test_credit_line_covers_what_the_accounts_cannot(make_event):
+    events = [make_event(name='rent', start_date=T(2025, 2, 1), frequency=None, value=-300.0)]
+    ladder = {'balances': {'main': 10000, 'savings': 10000},
+              'sources': [{'account': 'savings', 'notice_days': 0, 'penalty': 0}]}
+    credit_line = {'balance': 10000, 'limit': 50000}
+    cashflows = generate_cashflows(events, T(2025, 1, 1), T(2025, 2, 28), credit_line=credit_line, ladder=ladder)
+    assert [name for name, value, account in items_on(cashflows, T(2025, 2, 1)) if account == 'credit line'] == [
+        'Credit line draw']
+    assert sum(value for _, value, account in items_on(cashflows, T(2025, 2, 1)) if account == 'credit line') == -10000
+
+
+def test_vat_of_uncertain_events_is_scaled_by_probability(make_event):
+    events = [make_event(name='invoice', start_date=T(2025, 1, 15), frequency=None, value=120.0, vat_rate=20.0,
+                         probability=50.0)]
+    cashflows = generate_cashflows(events, T(2025, 1, 1), T(2025, 1, 31), 'monthly')
+    assert cashflows[0]['items'] == [{'name': 'invoice', 'value': 6000, 'account': 'main', 'vat': 1000,
+                                      'probability': 0.5}]
+    assert settlements(cashflows) == [(T(2025, 1, 31), -1000)]
+
+
+def test_validate_events_reports_rows_from_1(make_event):
+    problems = validate_events([make_event(), make_event(start_date=None, frequency='hourly')])
+    assert problems == [
+        {'row': 2, 'name': 'event', 'column': 'start_date', 'severity': 'error', 'error': 'missing start date'},
+        {'row': 2, 'name': 'event', 'column': 'frequency', 'severity': 'error', 'error': 'invalid frequency: hourly'},
+    ]
+
+
+def test_only_exclusive_events_must_not_overlap(make_event):
+    # same name events are simulated side by side unless marked exclusive
+    assert validate_events([make_event(name='insurance'), make_event(name='insurance')]) == []
+    problems = validate_events([make_event(name='rent', exclusive=True, end_date=T(2025, 6, 30)),
+                                make_event(name='rent', exclusive=True, start_date=T(2025, 7, 1)),
+                                make_event(name='rent', exclusive=True, start_date=T(2025, 9, 1), branch='move')])
+    assert problems == []
+    problems = validate_events([make_event(name='rent', exclusive=True),
+                                make_event(name='rent', exclusive=True, start_date=T(2025, 7, 1))])
+    assert [(p['row'], p['severity'], p['error']) for p in problems] == [
+        (2, 'warning', 'overlaps exclusive row 1 of the same name and branch')]
+
+
+def test_draft_events_are_not_checked_for_overlaps(make_event):
+    events = [make_event(name='rent', exclusive=True, state='draft', value=-1200.0),
+              make_event(name='rent', exclusive=True, value=-1000.0)]
+    assert validate_events(events) == []
+
+
+def test_failing_events_are_dropped(make_event):
+    events = [make_event(name='rent', value=-100.0),
+              make_event(name='consulting', currency='USD', start_date=T(2025, 1, 10)),
+              make_event(name='gym', frequency='fortnightly')]
+    fx_rates = [{'currency': 'USD', 'start_date': T(2025, 2, 1), 'rate': 5.0}]
+    errors = []
+    cashflows = generate_cashflows(events, T(2025, 1, 1), T(2025, 3, 31), base_currency='BRL', fx_rates=fx_rates,
+                                   errors=errors)
+    assert errors == [{'name': 'consulting', 'error': 'Missing FX rate for currency USD at 2025.01.10'},
+                      {'name': 'gym', 'error': 'Invalid frequency: fortnightly'}]
+    assert {item['name'] for cf in cashflows for item in cf['items']} == {'rent'}
+
+
+def test_cached_cashflows_over_the_item_limit(make_event):
+    # 12 occurrences per event, so the third event and the failing one are streamed
+    events = [make_event(name=f'event {i}', start_date=T(2025, 1, 1 + i)) for i in range(3)]
+    events.append(make_event(name='gym', frequency='fortnightly'))
+    stream, errors = iter_cashflows_cached(events, T(2025, 1, 1), T(2025, 12, 31), max_items=20)
+    cashflows, truncated = take_cashflows(stream, 20)
+    assert truncated
+    assert (cashflows, truncated) == take_cashflows(iter_cashflows(events, T(2025, 1, 1), T(2025, 12, 31), errors=[]),
+                                                    20)
+    assert [error['name'] for error in errors] == ['gym']
+
+
+def test_simulation_with_cached_events_matches_the_streamed_one(make_event):
+    events = [make_event(name=f'event {i}', start_date=T(2025, 1, 1 + i), vat_rate=10.0) for i in range(3)]
+    events.append(make_event(name='gym', frequency='fortnightly'))
+    args = (events, T(2025, 1, 1), T(2025, 12, 31), 'quarterly')
+    assert run_simulation(*args, cache_events=True) == run_simulation(*args)
+
+
+def test_split_delay_spreads_the_cents():
+    parts = split_delay({'name': 'invoice', 'value': -100.01, 'delay': 0, 'delay_max': 20})
+    assert [(part['delay'], part['value']) for part in parts] == [(0, -25.01), (7, -25.0), (14, -25.0), (20, -25.0)]
+    assert split_delay({'name': 'invoice', 'value': 100.0, 'delay': 10, 'delay_max': 10}) == [
+        {'name': 'invoice', 'value': 100.0, 'delay': 10, 'delay_max': 10}]
+
+
+def test_fx_conversion_with_shocks(make_event):
+    events = [make_event(name='consulting', value=100.0, currency='USD', end_date=T(2025, 3, 1))]
+    fx_rates = [{'currency': 'USD', 'start_date': pd.NaT, 'rate': 5.0},
+                {'currency': 'USD', 'start_date': T(2025, 2, 1), 'rate': 5.5}]
+    fx_shocks = [{'currency': 'USD', 'start_date': T(2025, 3, 1), 'end_date': T(2025, 3, 31), 'change': -10.0}]
+    cashflows = generate_cashflows(events, T(2025, 1, 1), T(2025, 3, 31), base_currency='BRL', fx_rates=fx_rates,
+                                   fx_shocks=fx_shocks)
+    assert [(cf['date'], item['value'], item['original_value']) for cf in cashflows for item in cf['items']] == [
+        (T(2025, 1, 1), 50000, 10000), (T(2025, 2, 1), 55000, 10000), (T(2025, 3, 1), 49500, 10000)]
+
+
+def test_credit_line_draws_charges_interest_and_repays():
+    cashflows = [{'date': T(2025, 1, 15), 'cashflow': -30000, 'balance': 0,
+                  'items': [{'name': 'rent', 'value': -30000, 'account': 'main'}]},
+                 {'date': T(2025, 3, 15), 'cashflow': 50000, 'balance': 0,
+                  'items': [{'name': 'salary', 'value': 50000, 'account': 'main'}]}]
+    result = apply_credit_line(iter(cashflows), T(2025, 1, 1), T(2025, 3, 31), balance=10000, limit=50000, apr=12)
+    # 20000 drawn for 17 days and 20112 for 28 days at 12% a year, the interest is drawn as well
+    assert [(cf['date'], item['name'], item['value']) for cf in result for item in cf['items']
+            if item['account'] == 'main'] == [
+        (T(2025, 1, 15), 'rent', -30000), (T(2025, 1, 15), 'Credit line draw', 20000),
+        (T(2025, 2, 1), 'Credit line interest', -112), (T(2025, 2, 1), 'Credit line draw', 112),
+        (T(2025, 3, 1), 'Credit line interest', -185), (T(2025, 3, 1), 'Credit line draw', 185),
+        (T(2025, 3, 15), 'salary', 50000), (T(2025, 3, 15), 'Credit line repayment', -20297),
+    ]
+
+
+def test_credit_line_stops_at_the_limit():
+    cashflows = [{'date': T(2025, 1, 15), 'cashflow': -30000, 'balance': 0,
+                  'items': [{'name': 'rent', 'value': -30000, 'account': 'main'}]}]
+    result = list(apply_credit_line(iter(cashflows), T(2025, 1, 1), T(2025, 1, 31), balance=0, limit=10000))
+    assert sum_by_account(result[0]['items']) == {'main': -20000, 'credit line': -10000}
+
+
+def test_find_infeasible():
+    balances = [{'date': T(2025, 1, 1), 'balance': 10.0, 'balance_main': 5.0, 'balance_savings': 5.0},
+                {'date': T(2025, 2, 1), 'balance': -20.0, 'balance_main': -30.0, 'balance_savings': 10.0},
+                {'date': T(2025, 3, 1), 'balance': -40.0, 'balance_main': -30.0, 'balance_savings': -10.0}]
+    assert find_infeasible(balances, {'main': 10, 'savings': 0}) == [
+        {'date': T(2025, 2, 1), 'account': 'main', 'balance': -30.0, 'limit': 10, 'shortfall': 20.0},
+        {'date': T(2025, 3, 1), 'account': 'savings', 'balance': -10.0, 'limit': 0, 'shortfall': 10.0}]
+
+
+def test_find_infeasible_of_a_single_account():
+    balances = [{'date': T(2025, 1, 1), 'balance': -5.0}]
+    assert find_infeasible(balances, {'main': 0, 'savings': 0}) == [
+        {'date': T(2025, 1, 1), 'account': 'main', 'balance': -5.0, 'limit': 0, 'shortfall': 5.0}]
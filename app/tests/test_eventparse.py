@@ -0,0 +1,53 @@
+from datetime import datetime
+import pytest
+from eventparse import parse_event, parse_number
+
+REFERENCE = datetime(2025, 1, 10, 15, 30)
+
+
+@pytest.mark.parametrize('text, number', [('1200', 1200), ('1,200.50', 1200.5), ('1.200,50', 1200.5),
+                                          ('12,5', 12.5), ('1.234.567', 1234567)])
+def test_parse_number(text, number):
+    assert parse_number(text) == number
+
+
+def test_parse_recurring_expense():
+    parsed = parse_event('R$ 1200 rent every month starting March 1st until end of 2027', REFERENCE)
+    assert parsed['event'] == {'name': 'Rent', 'start_date': datetime(2025, 3, 1), 'end_date': datetime(2027, 12, 31),
+                               'frequency': 'monthly', 'value': -1200, 'currency': 'BRL'}
+    assert parsed['ambiguities'] == []
+    assert parsed['confidence'] == 1.0
+
+
+def test_parse_income_with_thousands_suffix():
+    parsed = parse_event('bonus 5k in december', REFERENCE)
+    assert parsed['event']['value'] == 5000
+    assert parsed['event']['start_date'] == datetime(2025, 12, 1)
+    assert parsed['event']['frequency'] is None
+
+
+def test_defaults_are_reported_as_ambiguities():
+    parsed = parse_event('50', REFERENCE)
+    assert parsed['event']['start_date'] == datetime(2025, 1, 10)
+    assert parsed['event']['value'] == -50
+    assert parsed['event']['name'] == 'Expense'
+    assert len(parsed['ambiguities']) == 4
+    assert parsed['confidence'] == pytest.approx(0.4)
+
+
+def test_parse_day_first_date_with_article():
+    parsed = parse_event('receive 2k on the 15th of march', REFERENCE)
+    assert parsed['event']['name'] == 'Receive'
+    assert parsed['event']['start_date'] == datetime(2025, 3, 15)
+    assert parsed['event']['value'] == 2000
+
+
+def test_ambiguous_numeric_date_read_as_day_month():
+    parsed = parse_event('pay 10 on 03/04/2025', REFERENCE)
+    assert parsed['event']['start_date'] == datetime(2025, 4, 3)
+    assert '"03/04/2025" read as day/month' in parsed['ambiguities']
+
+
+def test_missing_amount():
+    with pytest.raises(ValueError, match='No amount found'):
+        parse_event('rent every month', REFERENCE)
@@ -0,0 +1,71 @@
+import io
+import openpyxl
+import pandas as pd
+import pytest
+import app
+from app import fold_ics, save_scenario, to_ics, to_xlsx
+
+T = pd.Timestamp
+
+
+def test_fold_ics_at_75_octets():
+    line = 'SUMMARY:' + 'é' * 30 + 'x' * 100
+    folded = fold_ics(line).split('\r\n')
+    assert all(len(part.encode('utf-8')) <= 75 for part in folded)
+    assert all(part.startswith(' ') for part in folded[1:])
+    assert ''.join(part[1:] if i else part for i, part in enumerate(folded)) == line
+
+
+def test_ics_uids_are_stable_per_event_and_date():
+    cashflows = [{'date': T(2025, 1, 1), 'items': [{'name': 'rent', 'value': -100000, 'account': 'main'},
+                                                   {'name': 'salary', 'value': 500000, 'account': 'main'}]},
+                 {'date': T(2025, 2, 1), 'items': [{'name': 'rent', 'value': -100000, 'account': 'main'}]}]
+
+    def uids(ics: bytes) -> list[str]:
+        return [line for line in ics.decode('utf-8').split('\r\n') if line.startswith('UID:')]
+
+    first = uids(to_ics(cashflows))
+    assert len(set(first)) == 3
+    assert first == uids(to_ics(cashflows[:1]) + to_ics(cashflows[1:]))
+
+
+def test_ics_transfers_show_the_moved_value():
+    cashflows = [{'date': T(2025, 1, 1), 'items': [
+        {'name': 'savings', 'value': -20000, 'account': 'main', 'transfer': True},
+        {'name': 'savings', 'value': 20000, 'account': 'savings', 'transfer': True}]}]
+    assert 'SUMMARY:savings: 200.00' in to_ics(cashflows).decode('utf-8')
+
+
+def results(dates: list) -> pd.DataFrame:
+    return pd.DataFrame({'date': dates, 'cashflow': [0.0] * len(dates), 'income': [0.0] * len(dates),
+                         'expenses': [0.0] * len(dates), 'balance': [0.0] * len(dates)})
+
+
+def test_xlsx_sheet_names_are_unique_case_insensitively():
+    names = ['Rent', 'rent', 'summary', 'a/b', 'x' * 40, 'x' * 41]
+    cashflows = [{'date': T(2025, 1, 1), 'items': [{'name': name, 'value': -100, 'account': 'main'}
+                                                   for name in names]}]
+    workbook = openpyxl.load_workbook(io.BytesIO(to_xlsx(results([T(2025, 1, 1)]), cashflows)))
+    assert workbook.sheetnames == ['Summary', 'Monthly', 'Rent', 'ab', 'rent_2', 'summary_2', 'x' * 31,
+                                   'x' * 29 + '_2']
+
+
+def test_xlsx_events_over_the_sheet_cap_share_one_sheet(monkeypatch):
+    monkeypatch.setattr(app, 'MAX_DETAIL_SHEETS', 2)
+    cashflows = [{'date': T(2025, 1, 1), 'items': [{'name': name, 'value': -100, 'account': 'main'}
+                                                   for name in ['a', 'b', 'c', 'd']]}]
+    workbook = openpyxl.load_workbook(io.BytesIO(to_xlsx(results([T(2025, 1, 1)]), cashflows)))
+    assert workbook.sheetnames == ['Summary', 'Monthly', 'a', 'b', 'Other events']
+    assert [row[0] for row in workbook['Other events'].iter_rows(min_row=2, values_only=True)] == ['c', 'd']
+
+
+@pytest.mark.parametrize('name, file_name', [('../../etc/passwd', 'etcpasswd.csv'), ('  .hidden  ', 'hidden.csv'),
+                                             ('plan 2025.xlsx', 'plan 2025.xlsx')])
+def test_save_scenario_sanitizes_the_name(tmp_path, name, file_name):
+    assert save_scenario({'df': pd.DataFrame({'name': ['rent']})}, str(tmp_path), name) == file_name
+    assert [path.name for path in tmp_path.iterdir()] == [file_name]
+
+
+def test_save_scenario_rejects_names_without_safe_characters(tmp_path):
+    with pytest.raises(ValueError, match='Invalid scenario name'):
+        save_scenario({'df': pd.DataFrame({'name': ['rent']})}, str(tmp_path), '../')
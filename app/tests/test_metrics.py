@@ -0,0 +1,102 @@
+from datetime import datetime
+import pytest
+from metrics import (billing_cycles, earliest_affordable_date, health_score, key_metrics, months_between,
+                     networth_statement, npv, payback_date, period_summary, runway, savings_rate, threshold_alerts,
+                     xirr)
+
+
+def balances(*rows) -> list[dict]:
+    # (date, income, expenses) rows after a current balance of 0 on 2025-01-01
+    result = [{'date': datetime(2025, 1, 1), 'cashflow': 0, 'income': 0, 'expenses': 0, 'balance': 0, 'items': ''}]
+    for date, income, expenses in rows:
+        cashflow = income + expenses
+        result.append({'date': date, 'cashflow': cashflow, 'income': income, 'expenses': expenses,
+                       'balance': result[-1]['balance'] + cashflow, 'items': f'{cashflow}'})
+    return result
+
+
+def test_npv_discounts_by_year_fraction():
+    cashflows = [{'date': datetime(2025, 1, 1), 'cashflow': -100}, {'date': datetime(2026, 1, 1), 'cashflow': 110}]
+    assert npv(cashflows, 0.1, datetime(2025, 1, 1)) == pytest.approx(0, abs=1e-9)
+
+
+def test_xirr():
+    cashflows = [{'date': datetime(2025, 1, 1), 'cashflow': -100}, {'date': datetime(2026, 1, 1), 'cashflow': 110}]
+    assert xirr(cashflows) == pytest.approx(0.1, abs=1e-6)
+    assert xirr([{'date': datetime(2025, 1, 1), 'cashflow': 100}]) is None
+
+
+def test_payback_date_after_initial_outlay():
+    cashflows = [{'date': datetime(2025, 1, 1), 'cashflow': -100},
+                 {'date': datetime(2025, 2, 1), 'cashflow': 50},
+                 {'date': datetime(2025, 3, 1), 'cashflow': 50}]
+    assert payback_date(cashflows) == datetime(2025, 3, 1)
+
+
+def test_months_between_counts_complete_months():
+    assert months_between(datetime(2025, 1, 15), datetime(2025, 3, 14)) == 1
+    assert months_between(datetime(2025, 1, 15), datetime(2025, 3, 15)) == 2
+
+
+def test_runway_and_income_needed():
+    plan = balances((datetime(2025, 2, 1), 0, -300), (datetime(2025, 4, 1), 100, 0))
+    result = runway(plan)
+    assert result['first_negative_date'] == datetime(2025, 2, 1)
+    assert result['runway_months'] == 1
+    assert result['min_monthly_income'] == 150
+
+
+def test_threshold_alerts_in_both_directions():
+    plan = balances((datetime(2025, 2, 1), 0, -100), (datetime(2025, 3, 1), 200, 0))
+    alerts = threshold_alerts(plan, [0])
+    assert [(a['date'], a['direction']) for a in alerts] == [(datetime(2025, 2, 1), 'below'),
+                                                             (datetime(2025, 3, 1), 'above')]
+
+
+def test_billing_cycles_group_dates_within_window():
+    plan = balances((datetime(2025, 1, 3), 10, 0), (datetime(2025, 1, 20), 0, -5))
+    cycles = billing_cycles(plan, 5)
+    assert [(c['start_date'], c['end_date'], c['cashflow']) for c in cycles] == [
+        (datetime(2025, 1, 1), datetime(2025, 1, 3), 10), (datetime(2025, 1, 20), datetime(2025, 1, 20), -5)]
+
+
+def test_earliest_affordable_date_keeps_later_balances_above_floor():
+    plan = balances((datetime(2025, 2, 1), 500, 0), (datetime(2025, 3, 1), 0, -200), (datetime(2025, 4, 1), 500, 0))
+    assert earliest_affordable_date(plan, 300) == datetime(2025, 2, 1)
+    assert earliest_affordable_date(plan, 600) == datetime(2025, 4, 1)
+    assert earliest_affordable_date(plan, 900) is None
+
+
+def test_networth_statement_reports_negative_accounts_as_liabilities():
+    rows = [{'date': datetime(2025, 1, 31), 'balance': 50, 'balance_main': 150, 'balance_card': -100}]
+    assert networth_statement(rows) == [{'month': '2025-01', 'balance_main': 150, 'balance_card': -100,
+                                         'assets': 150, 'liabilities': -100, 'net_worth': 50}]
+
+
+def test_period_summary_does_not_net_same_date_items():
+    plan = balances((datetime(2025, 2, 1), 1000, -1100), (datetime(2025, 2, 15), 200, 0))
+    assert period_summary(plan)[1] == {'period': '2025-02', 'opening_balance': 0, 'income': 1200, 'expenses': -1100,
+                                       'net': 100, 'closing_balance': 100}
+
+
+def test_savings_rate_does_not_net_same_date_items():
+    plan = balances((datetime(2025, 2, 1), 1000, -1100), (datetime(2025, 3, 1), 1000, -500))
+    assert savings_rate(plan) == pytest.approx(0.2)
+    assert key_metrics(plan)['savings_rate'] == pytest.approx(0.2)
+    assert savings_rate(balances()) is None
+
+
+def test_health_score_goal_coverage():
+    plan = balances((datetime(2025, 2, 1), 1000, -500))
+    assert 'goal_coverage' not in health_score(plan)['components']
+    assert health_score(plan, 1000)['components']['goal_coverage'] == 50
+    assert health_score(plan, 100)['components']['goal_coverage'] == 100
+
+
+def test_key_metrics():
+    plan = balances((datetime(2025, 2, 1), 0, -100), (datetime(2025, 2, 11), 300, 0))
+    metrics = key_metrics(plan)
+    assert metrics['min_balance'] == -100
+    assert metrics['min_balance_date'] == datetime(2025, 2, 1)
+    assert metrics['longest_negative_days'] == 10
+    assert metrics['end_balance_cagr'] is None
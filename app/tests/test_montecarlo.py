@@ -0,0 +1,119 @@
+from datetime import datetime
+import numpy as np
+import pytest
+from montecarlo import (correlated_normals, distribution_assumptions, inflation_paths, path_statistics,
+                        probability_negative, safe_withdrawal, sample_values, simulate_balances)
+
+CORRELATIONS = [{'event_a': 'a', 'event_b': 'b', 'correlation': 0.9}]
+
+
+def test_correlated_normals():
+    normals = correlated_normals(['a', 'b'], CORRELATIONS, 20000, np.random.default_rng(1), draws=2)
+    assert normals['a'].shape == (20000, 2)
+    assert np.corrcoef(normals['a'][:, 0], normals['b'][:, 0])[0, 1] == pytest.approx(0.9, abs=0.02)
+    assert np.corrcoef(normals['a'][:, 0], normals['a'][:, 1])[0, 1] == pytest.approx(0, abs=0.03)
+
+
+def test_correlation_matrix_must_be_positive_definite():
+    correlations = [{'event_a': 'a', 'event_b': 'b', 'correlation': 0.9},
+                    {'event_a': 'b', 'event_b': 'c', 'correlation': 0.9},
+                    {'event_a': 'a', 'event_b': 'c', 'correlation': -0.9}]
+    with pytest.raises(ValueError, match='positive definite'):
+        correlated_normals(['a', 'b', 'c'], correlations, 10, np.random.default_rng(1))
+
+
+def test_certain_items_keep_their_value():
+    samples = sample_values([{'name': 'rent', 'value': -1000}], 100, np.random.default_rng(1))
+    assert (samples == -1000).all()
+
+
+def test_uncertain_items_happen_with_their_probability():
+    # the item value is the expected value, so the sampled value is the full one when it happens
+    samples = sample_values([{'name': 'bonus', 'value': 50, 'probability': 0.5}], 20000, np.random.default_rng(1))
+    assert set(np.unique(samples)) == {0, 100}
+    assert samples.mean() == pytest.approx(50, abs=2)
+
+
+@pytest.mark.parametrize('distribution', ['normal', 'uniform', 'triangular'])
+def test_distributions_are_centered_on_the_value(distribution):
+    item = {'name': 'sales', 'value': 1000, 'distribution': distribution, 'spread': 10}
+    samples = sample_values([item], 20000, np.random.default_rng(1))
+    assert samples.mean() == pytest.approx(1000, abs=3)
+    if distribution != 'normal':
+        assert 900 <= samples.min() and samples.max() <= 1100
+
+
+def test_correlated_events_are_drawn_per_date():
+    items = [{'name': name, 'value': 100, 'distribution': 'normal', 'spread': 10} for name in ('a', 'b', 'a', 'b')]
+    samples = sample_values(items, 20000, np.random.default_rng(1), CORRELATIONS, np.array([0, 0, 1, 1]))
+    assert np.corrcoef(samples[:, 0], samples[:, 1])[0, 1] == pytest.approx(0.9, abs=0.02)
+    assert np.corrcoef(samples[:, 0], samples[:, 2])[0, 1] == pytest.approx(0, abs=0.03)
+
+
+def test_simulate_balances_of_certain_cashflows():
+    cashflows = [{'date': datetime(2025, 1, 1), 'items': [{'name': 'a', 'value': -300}, {'name': 'b', 'value': 100}]},
+                 {'date': datetime(2025, 2, 1), 'items': [{'name': 'a', 'value': 50}]}]
+    balances = simulate_balances(cashflows, 100, 3, np.random.default_rng(1))
+    assert balances.tolist() == [[-100, -50]] * 3
+    assert probability_negative(100, balances) == 1.0
+    statistics = path_statistics(cashflows, balances, [50])
+    assert [(s['date'], s['p50'], s['ruin_probability']) for s in statistics] == [
+        (datetime(2025, 1, 1), -1.0, 1.0), (datetime(2025, 2, 1), -0.5, 1.0)]
+
+
+def test_only_uncertain_items_are_sampled():
+    cashflows = [{'date': datetime(2025, 1, 1), 'items': [{'name': 'rent', 'value': -300},
+                                                         {'name': 'bonus', 'value': 50, 'probability': 0.5}]}]
+    balances = simulate_balances(cashflows, 1000, 1000, np.random.default_rng(1))
+    assert set(np.unique(balances)) == {700, 800}
+    with pytest.raises(ValueError, match='Too many samples'):
+        simulate_balances(cashflows, 1000, 1000, np.random.default_rng(1), max_samples=999)
+
+
+def test_distribution_assumptions_of_uncertain_items():
+    cashflows = [{'date': datetime(2025, 1, 1), 'items': [{'name': 'rent', 'value': -100},
+                                                         {'name': 'sales', 'value': 90, 'distribution': 'normal',
+                                                          'spread': 5, 'probability': 0.9}]}]
+    assert distribution_assumptions(cashflows) == [{'name': 'sales', 'distribution': 'normal', 'spread': 5,
+                                                    'probability': 0.9}]
+
+
+def test_safe_withdrawal_is_reproducible_with_a_seed():
+    args = (1000000, 0.04, 0.03, 0.07, 0.15, 30, 1000)
+    first = safe_withdrawal(*args, np.random.default_rng(42))
+    assert first == safe_withdrawal(*args, np.random.default_rng(42))
+    assert 0 <= first['success_probability'] <= 1
+    assert len(first['bands']) == 30
+
+
+def test_safe_withdrawal_without_risk():
+    result = safe_withdrawal(1000, 0.1, 0, 0, 0, 5, 10, np.random.default_rng(1))
+    assert result['success_probability'] == 1.0
+    assert result['bands'][-1]['p50'] == pytest.approx(500)
+
+
+def test_inflation_paths_revert_to_the_mean():
+    rates = inflation_paths(0.03, 0.01, 0.5, 30, 20000, np.random.default_rng(1))
+    assert (rates[:, 0] == 0.03).all()
+    assert rates[:, -1].mean() == pytest.approx(0.03, abs=0.0005)
+    # stationary std dev of an AR(1) process with coefficient 1 - reversion
+    assert rates[:, -1].std() == pytest.approx(0.01 / np.sqrt(1 - 0.5 ** 2), rel=0.05)
+
+
+def test_safe_withdrawal_with_stochastic_inflation():
+    # without return risk the fixed 3% inflation plan succeeds, while high inflation paths run out
+    fixed = safe_withdrawal(1000000, 0.04, 0.03, 0.05, 0, 30, 2000, np.random.default_rng(1))
+    stochastic = safe_withdrawal(1000000, 0.04, 0.03, 0.05, 0, 30, 2000, np.random.default_rng(1), 0.02, 0.2)
+    assert fixed['success_probability'] == 1.0
+    assert 0 < stochastic['success_probability'] < 1
+
+
+def test_safe_withdrawal_resamples_historical_years():
+    result = safe_withdrawal(1000, 0.1, 0.5, 0.07, 0.15, 1, 1000, np.random.default_rng(1),
+                             historical_returns=[0.1, -0.1], historical_inflation=[0.0, 0.0])
+    assert result['bands'][0]['p5'] == pytest.approx(900 * 0.9)
+    assert result['bands'][0]['p95'] == pytest.approx(900 * 1.1)
+    # the inflation of the sampled year replaces the annual inflation
+    result = safe_withdrawal(1000, 0.1, 0.5, 0.07, 0.15, 5, 10, np.random.default_rng(1),
+                             historical_returns=[0.0], historical_inflation=[0.0])
+    assert result['bands'][-1]['p50'] == pytest.approx(500)
@@ -0,0 +1,31 @@
+import json
+import pytest
+from scenario import SCHEMA_VERSION, SECTIONS, dump_scenario, load_scenario
+
+
+def test_dump_and_load_round_trip():
+    sections = {'events': [{'name': 'Rent', 'value': -1000}], 'accounts': [{'account': 'savings', 'balance': 10}]}
+    loaded = load_scenario(dump_scenario(sections))
+    assert loaded['events'] == sections['events']
+    assert loaded['accounts'] == sections['accounts']
+    assert all(loaded[section] == [] for section in SECTIONS if section not in sections)
+
+
+def test_dump_writes_current_version():
+    assert json.loads(dump_scenario({}))['version'] == SCHEMA_VERSION
+
+
+def test_version_0_list_of_events_is_migrated():
+    assert load_scenario('[{"name": "Rent"}]')['events'] == [{'name': 'Rent'}]
+
+
+@pytest.mark.parametrize('text, error', [('{"events": []}', 'Missing scenario version'),
+                                         (f'{{"version": {SCHEMA_VERSION + 1}}}', 'newer than the supported')])
+def test_invalid_scenarios(text, error):
+    with pytest.raises(ValueError, match=error):
+        load_scenario(text)
+
+
+def test_invalid_json():
+    with pytest.raises(ValueError):
+        load_scenario('{')
@@ -0,0 +1,86 @@
+from datetime import datetime
+import pytest
+from statement import detect_recurring, normalize_payee, parse_amount, parse_qif_date, parse_statement
+
+OFX = '''<OFX><BANKTRANLIST>
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20250105120000<TRNAMT>-1,234.56<NAME>RENT CO
+<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>20250101<TRNAMT>2500.00<NAME>ACME PAYROLL</STMTTRN>
+</BANKTRANLIST></OFX>'''
+QIF = '''!Type:Bank
+D1/15'25
+T-1,234.00
+PRent
+^
+D2025-02-15
+T1.234,56
+PRefund
+^
+D13/45/2025
+T10
+PBroken
+^
+'''
+MT940 = ''':20:STATEMENT
+:61:2501150115D1234,56NTRFNONREF
+:86:RENT CO
+JANUARY
+:61:2501200120C100,NTRFNONREF
+'''
+
+
+@pytest.mark.parametrize('text, amount', [('1,234.56', 1234.56), ('1.234,56', 1234.56), ('-1,234', -1234),
+                                          ('12,5', 12.5), ('1.234.567', 1234567), ('+3.10', 3.1)])
+def test_parse_amount(text, amount):
+    assert parse_amount(text) == amount
+
+
+def test_parse_qif_date_formats():
+    assert parse_qif_date("1/15'25") == datetime(2025, 1, 15)
+    assert parse_qif_date('01/15/2025') == datetime(2025, 1, 15)
+    assert parse_qif_date('2025-01-15') == datetime(2025, 1, 15)
+    with pytest.raises(ValueError):
+        parse_qif_date('15.01.2025')
+
+
+def test_parse_ofx_sorted_by_date():
+    transactions = parse_statement('statement.ofx', OFX)
+    assert transactions == [
+        {'date': datetime(2025, 1, 1), 'payee': 'ACME PAYROLL', 'amount': 2500.0},
+        {'date': datetime(2025, 1, 5), 'payee': 'RENT CO', 'amount': -1234.56},
+    ]
+
+
+def test_parse_qif_skips_and_reports_bad_records():
+    errors = []
+    transactions = parse_statement('statement.QIF', QIF, errors)
+    assert [(t['date'], t['amount']) for t in transactions] == [(datetime(2025, 1, 15), -1234.0),
+                                                                 (datetime(2025, 2, 15), 1234.56)]
+    assert [error['transaction'] for error in errors] == [3]
+    with pytest.raises(ValueError):
+        parse_statement('statement.qif', QIF)
+
+
+def test_parse_mt940():
+    transactions = parse_statement('statement.sta', MT940)
+    assert transactions == [
+        {'date': datetime(2025, 1, 15), 'payee': 'RENT CO JANUARY', 'amount': -1234.56},
+        {'date': datetime(2025, 1, 20), 'payee': '', 'amount': 100.0},
+    ]
+
+
+def test_parse_statement_rejects_unknown_format():
+    with pytest.raises(ValueError, match='Unsupported statement format'):
+        parse_statement('statement.pdf', '')
+
+
+def test_normalize_payee_drops_reference_numbers():
+    assert normalize_payee('NETFLIX.COM 12345') == normalize_payee('Netflix.com 67890') == 'netflix com'
+
+
+def test_detect_recurring_monthly_payee():
+    transactions = [{'date': datetime(2025, month, 1), 'payee': f'NETFLIX {month}', 'amount': -15.99}
+                    for month in range(1, 5)]
+    transactions.append({'date': datetime(2025, 2, 10), 'payee': 'SHOP', 'amount': -50})
+    assert detect_recurring(transactions) == [{
+        'name': 'NETFLIX', 'start_date': datetime(2025, 1, 1), 'frequency': 'monthly', 'value': -15.99,
+        'occurrences': 4, 'last_date': datetime(2025, 4, 1)}]